@@ -0,0 +1,457 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type flatStruct struct {
+	Id     int
+	Count  int32
+	Ratio  float32
+	Price  float64
+	Amount float64
+	Name   string
+	Code   string
+}
+
+type deepLeaf struct {
+	Value float64
+	Label string
+}
+
+type deepLevel3 struct {
+	Id   int
+	Leaf deepLeaf
+}
+
+type deepLevel2 struct {
+	Id    int
+	Inner deepLevel3
+	Items []deepLevel3
+}
+
+type deepLevel1 struct {
+	Id    int
+	Inner deepLevel2
+	Items []deepLevel2
+}
+
+type deepStruct struct {
+	Name  string
+	Inner deepLevel1
+	Items []deepLevel1
+}
+
+type largeSliceStruct struct {
+	Floats []float64
+	Ids    []int32
+}
+
+type stringsStruct struct {
+	Title   string
+	Strings []string
+}
+
+type mapsStruct struct {
+	Scores map[string]float64
+	Names  map[int]string
+}
+
+func newDeepStruct() deepStruct {
+
+	level3 := deepLevel3{Id: 3, Leaf: deepLeaf{0.25, "leaf"}}
+	level2 := deepLevel2{Id: 2, Inner: level3, Items: []deepLevel3{level3, level3, level3}}
+	level1 := deepLevel1{Id: 1, Inner: level2, Items: []deepLevel2{level2, level2, level2}}
+
+	return deepStruct{Name: "deep", Inner: level1, Items: []deepLevel1{level1, level1, level1}}
+}
+
+// slices are as large as a single reference allows, 64KB each
+func newLargeSliceStruct() largeSliceStruct {
+
+	result := largeSliceStruct{Floats: make([]float64, 8000), Ids: make([]int32, 16000)}
+
+	for i := range result.Floats {
+		result.Floats[i] = float64(i) * 1.5
+		result.Ids[i] = int32(i)
+		result.Ids[i+8000] = int32(-i)
+	}
+
+	return result
+}
+
+func newStringsStruct() stringsStruct {
+
+	result := stringsStruct{Title: "strings", Strings: make([]string, 1000)}
+
+	for i := range result.Strings {
+		result.Strings[i] = "value number " + strconv.Itoa(i*7919)
+	}
+
+	return result
+}
+
+func newMapsStruct() mapsStruct {
+
+	result := mapsStruct{Scores: make(map[string]float64, 500), Names: make(map[int]string, 500)}
+
+	for i := 0; i < 500; i++ {
+		result.Scores["player"+strconv.Itoa(i)] = float64(i) / 3
+		result.Names[i] = "name" + strconv.Itoa(i)
+	}
+
+	return result
+}
+
+var benchmarkShapes = []struct {
+	name  string
+	value interface{}
+}{
+	{"flat", flatStruct{49, 7, 0.5, 10.95, 32720.2383, "product name", "AB-1234"}},
+	{"nested", newTestStruct(10)},
+	{"deep", newDeepStruct()},
+	{"large_slice", newLargeSliceStruct()},
+	{"strings", newStringsStruct()},
+	{"maps", newMapsStruct()},
+}
+
+func reportEncoded(b *testing.B, encoded []byte) {
+	b.SetBytes(int64(len(encoded)))
+	b.ReportMetric(float64(len(encoded)), "encoded_bytes")
+}
+
+func gobEncode(b *testing.B, buf *bytes.Buffer, v interface{}) {
+	buf.Reset()
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+
+	for _, shape := range benchmarkShapes {
+
+		value := shape.value
+
+		b.Run(shape.name+"/transbin_full", func(b *testing.B) {
+			ctx := NewEncodeContext(newTestCodec(b, binary.LittleEndian))
+
+			var encoded []byte
+			var err error
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, err = ctx.EncodeFull(value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/transbin_data", func(b *testing.B) {
+			ctx := NewEncodeContext(newTestCodec(b, binary.LittleEndian))
+
+			var encoded []byte
+			var err error
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, err = ctx.Encode(value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/transbin_dedup", func(b *testing.B) {
+			ctx := NewEncodeContext(newTestCodec(b, binary.LittleEndian))
+			ctx.SetOptions(EncodeOptions{Header: true, Deduplicate: true})
+
+			var encoded []byte
+			var err error
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, err = ctx.EncodeFull(value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/transbin_unsafe", func(b *testing.B) {
+			ctx := NewEncodeContext(newTestCodec(b, binary.LittleEndian))
+			ctx.SetOptions(EncodeOptions{Header: true, UnsafeFieldAccess: true})
+
+			// unsafe access needs an addressable value
+			ptr := reflect.New(reflect.TypeOf(value))
+			ptr.Elem().Set(reflect.ValueOf(value))
+			addressable := ptr.Interface()
+
+			var encoded []byte
+			var err error
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, err = ctx.EncodeFull(addressable)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/json", func(b *testing.B) {
+			var encoded []byte
+			var err error
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoded, err = json.Marshal(value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/gob", func(b *testing.B) {
+			var buf bytes.Buffer
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				gobEncode(b, &buf, value)
+			}
+
+			reportEncoded(b, buf.Bytes())
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+
+	for _, shape := range benchmarkShapes {
+
+		value := shape.value
+		valueType := reflect.TypeOf(value)
+
+		b.Run(shape.name+"/transbin_full", func(b *testing.B) {
+			encoded, err := newTestCodec(b, binary.LittleEndian).Marshal(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx := NewDecodeContext(newTestCodec(b, binary.LittleEndian))
+			out := reflect.New(valueType).Interface()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = ctx.Decode(out, encoded)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/transbin_data", func(b *testing.B) {
+			c := newTestCodec(b, binary.LittleEndian)
+			encoder := NewEncodeContext(c)
+
+			full, err := encoder.EncodeFullCopy(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+			encoded, err := encoder.EncodeCopy(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx := NewDecodeContext(newTestCodec(b, binary.LittleEndian))
+			out := reflect.New(valueType).Interface()
+
+			// structure definitions are learned once
+			err = ctx.Decode(out, full)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = ctx.Decode(out, encoded)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/transbin_canonical", func(b *testing.B) {
+			encoded, err := newCanonicalCodec(b).Marshal(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			// decoder has its own structures under ids of the message
+			c := newTestCodec(b, binary.LittleEndian)
+			_, err = c.Marshal(mixedStruct{})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx := NewDecodeContext(c)
+			out := reflect.New(valueType).Interface()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = ctx.Decode(out, encoded)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/transbin_unsafe", func(b *testing.B) {
+			encoded, err := newTestCodec(b, binary.LittleEndian).Marshal(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx := NewDecodeContext(newTestCodec(b, binary.LittleEndian))
+			ctx.SetOptions(DecodeOptions{UnsafeFieldAccess: true})
+			out := reflect.New(valueType).Interface()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = ctx.Decode(out, encoded)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/json", func(b *testing.B) {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			out := reflect.New(valueType).Interface()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = json.Unmarshal(encoded, out)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+
+		b.Run(shape.name+"/gob", func(b *testing.B) {
+			var buf bytes.Buffer
+			gobEncode(b, &buf, value)
+			encoded := buf.Bytes()
+
+			out := reflect.New(valueType).Interface()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(out)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportEncoded(b, encoded)
+		})
+	}
+}
+
+// single field out of a message, compared to decoding all of it
+func BenchmarkGet(b *testing.B) {
+
+	paths := []struct {
+		shape string
+		path  string
+	}{
+		{"nested", "NestedStruct.7.Product.Price"},
+		{"deep", "Items.2.Items.1.Inner.Leaf.Label"},
+		{"large_slice", "Ids.12000"},
+		{"maps", "Scores.player250"},
+	}
+
+	for _, p := range paths {
+
+		var value interface{}
+		for _, shape := range benchmarkShapes {
+			if shape.name == p.shape {
+				value = shape.value
+			}
+		}
+
+		encoded, err := newTestCodec(b, binary.LittleEndian).Marshal(value)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(p.shape+"/get", func(b *testing.B) {
+			ctx := NewDecodeContext(newTestCodec(b, binary.LittleEndian))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := ctx.Get(encoded, p.path)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(p.shape+"/decode", func(b *testing.B) {
+			ctx := NewDecodeContext(newTestCodec(b, binary.LittleEndian))
+			out := reflect.New(reflect.TypeOf(value)).Interface()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := ctx.Decode(out, encoded)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package codec
+
+import (
+	"encoding/binary"
+	"reflect"
+	"unsafe"
+)
+
+// nativeOrder is byte order of the host. numeric slices are copied as memory blocks
+// when message is in the same order
+var nativeOrder = func() binary.ByteOrder {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// bulkElementSize returns size of elements, if Go slices of elements of kind k
+// have the same memory layout as arrays of wire type t. returns 0 otherwise
+func bulkElementSize(t uint16, k reflect.Kind) int {
+
+	if reflect.Kind(t) != k {
+		return 0
+	}
+
+	switch k {
+	case reflect.Uint8:
+		return 1
+	case reflect.Int32, reflect.Float32:
+		return 4
+	case reflect.Float64:
+		return 8
+	}
+
+	return 0
+}
+
+// sliceBytes returns memory of slice v, which has elements of size bytes
+func sliceBytes(v reflect.Value, size int) []byte {
+
+	var result []byte
+
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&result))
+	header.Data = v.Pointer()
+	header.Len = v.Len() * size
+	header.Cap = header.Len
+
+	return result
+}
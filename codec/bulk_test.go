@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type sample float64
+
+type telemetry struct {
+	Samples []sample
+	Floats  []float32
+	Ids     []int32
+	Ints    []int
+}
+
+func TestBulkNumericSlices(t *testing.T) {
+
+	original := telemetry{
+		Samples: []sample{0, -1.5, math.MaxFloat64, math.SmallestNonzeroFloat64},
+		Floats:  []float32{1.25, -3, math.MaxFloat32},
+		Ids:     []int32{math.MinInt32, -1, 0, 1, math.MaxInt32},
+		Ints:    []int{7, -7},
+	}
+
+	// one of the orders is native and copied as a block, another is written element by element
+	var decoded []telemetry
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		encoded, err := newTestCodec(t, order).Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, decoderOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+			var out telemetry
+			err = newTestCodec(t, decoderOrder).Unmarshal(encoded, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded = append(decoded, out)
+		}
+	}
+
+	for i, out := range decoded {
+		if !reflect.DeepEqual(original, out) {
+			t.Fatalf("decoding %d differs\nwant %+v\ngot  %+v", i, original, out)
+		}
+	}
+}
+
+func TestBulkNumericSliceLayout(t *testing.T) {
+
+	values := []float64{1.5, -2}
+
+	c := newTestCodec(t, nativeOrder)
+	c.SetEncodeOptions(EncodeOptions{})
+
+	encoded, err := c.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// references table ends with the array data
+	data := encoded[len(encoded)-16:]
+	for i, v := range values {
+		if nativeOrder.Uint64(data[i*8:]) != math.Float64bits(v) {
+			t.Fatalf("element %d is not written in host order", i)
+		}
+	}
+}
+
+// byte slices have no order, so they are copied as blocks in messages of any order
+func TestBulkByteSlices(t *testing.T) {
+
+	original := attachment{Name: "blob", Data: []byte{0, 1, 0xfe, 0xff}, Notes: []string{}}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		encoded, err := newTestCodec(t, order).Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out attachment
+		err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &out)
+		if err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+
+		if !reflect.DeepEqual(original, out) {
+			t.Fatalf("%s: decoded value differs\nwant %+v\ngot  %+v", order, original, out)
+		}
+
+		decoded, err := newTestCodec(t, binary.BigEndian).AcquireDecoder().DecodeDynamic(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := decoded.(map[string]interface{})["Data"]
+		if !reflect.DeepEqual(data, original.Data) {
+			t.Fatalf("%s: byte slice decoded dynamically as %#v", order, data)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package codec
+
+import (
+	"math"
+	"reflect"
+	"sort"
+)
+
+type mapEntry struct {
+	key   reflect.Value
+	value reflect.Value
+}
+
+// sortedMapEntries returns entries of map v in canonical order. NaN keys are never equal,
+// so entries are read by iteration and the ones with equal keys are ordered by values
+func sortedMapEntries(v reflect.Value) []mapEntry {
+
+	entries := make([]mapEntry, 0, v.Len())
+
+	iter := v.MapRange()
+	for iter.Next() {
+		entries = append(entries, mapEntry{iter.Key(), iter.Value()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if c := compareValues(entries[i].key, entries[j].key); c != 0 {
+			return c < 0
+		}
+		return compareValues(entries[i].value, entries[j].value) < 0
+	})
+
+	return entries
+}
+
+// compareValues returns -1, 0 or 1 as a is ordered before, with or after b.
+// values of interface types are ordered by kind first. NaNs go before other numbers,
+// ordered by their bits. structures and arrays are compared element by element,
+// pointers by values they point to, nil ones first. slices and maps are equal
+func compareValues(a, b reflect.Value) int {
+
+	if a.Kind() == reflect.Interface {
+		a = a.Elem()
+	}
+	if b.Kind() == reflect.Interface {
+		b = b.Elem()
+	}
+
+	if a.Kind() != b.Kind() {
+		return compareInts(int64(a.Kind()), int64(b.Kind()))
+	}
+
+	switch a.Kind() {
+	case reflect.String:
+		return compareStrings(a.String(), b.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareInts(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return compareUints(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float())
+	case reflect.Bool:
+		return compareInts(boolInt(a.Bool()), boolInt(b.Bool()))
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if c := compareValues(a.Field(i), b.Field(i)); c != 0 {
+				return c
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if c := compareValues(a.Index(i), b.Index(i)); c != 0 {
+				return c
+			}
+		}
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			return compareInts(boolInt(!a.IsNil()), boolInt(!b.IsNil()))
+		}
+		return compareValues(a.Elem(), b.Elem())
+	}
+
+	// nil interfaces, slices, maps and channels
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+
+	aNaN, bNaN := math.IsNaN(a), math.IsNaN(b)
+
+	switch {
+	case aNaN && bNaN:
+		return compareUints(math.Float64bits(a), math.Float64bits(b))
+	case aNaN:
+		return -1
+	case bNaN:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
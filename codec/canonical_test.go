@@ -0,0 +1,321 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type canonicalStruct struct {
+	Scores map[string]float64
+	Names  map[int]string
+	Items  map[string]ProductVal
+	Any    interface{}
+	Nested NStruct
+}
+
+func newCanonicalStruct() canonicalStruct {
+
+	result := canonicalStruct{
+		Scores: make(map[string]float64),
+		Names:  make(map[int]string),
+		Items:  make(map[string]ProductVal),
+		Any:    "any value",
+	}
+
+	for i := 0; i < 50; i++ {
+		result.Scores["k"+strconv.Itoa(i)] = float64(i)
+		result.Names[i*7-100] = strconv.Itoa(i)
+		result.Items[strconv.Itoa(i)] = ProductVal{strconv.Itoa(i), float64(i)}
+	}
+
+	return result
+}
+
+func newCanonicalCodec(t testing.TB) *codec {
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, Canonical: true})
+	return c
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+
+	value := newCanonicalStruct()
+
+	first, err := newCanonicalCodec(t).Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// registration order of the codec doesn't matter
+	c := newCanonicalCodec(t)
+	for _, v := range []interface{}{TestStruct{}, MapValStruct{}, mixedStruct{}} {
+		_, err = c.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		encoded, err := c.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(first, encoded) {
+			t.Fatalf("encoding %d differs", i)
+		}
+	}
+
+	var decoded canonicalStruct
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(first, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(value, decoded) {
+		t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", value, decoded)
+	}
+}
+
+func TestConflictingDefinitions(t *testing.T) {
+
+	// decoder registers its own structures under the ids canonical messages use
+	c := newTestCodec(t, binary.LittleEndian)
+
+	own := newTestStruct(2)
+
+	ownEncoded, err := c.Marshal(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(c)
+
+	for _, value := range []interface{}{MapValStruct{5, "five"}, mixedStruct{1, 2, []float64{3}, []string{"s"}, map[string]interface{}{"a": "b"}, map[string]int{"c": 4}, 5.5, []ProductVal{{"p", 2}}}, NStruct{Nint: 1}} {
+
+		encoded, err := newCanonicalCodec(t).Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := reflect.New(reflect.TypeOf(value))
+		err = ctx.Decode(out.Interface(), encoded)
+		if err != nil {
+			t.Fatalf("%T: %v", value, err)
+		}
+
+		if !reflect.DeepEqual(value, out.Elem().Interface()) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", value, out.Elem().Interface())
+		}
+
+		// registered definitions are used again, once a message brings them
+		var decoded TestStruct
+		err = ctx.Decode(&decoded, ownEncoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(own, decoded) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", own, decoded)
+		}
+	}
+
+	// codec encodes its own types as before
+	encoded, err := c.Marshal(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(encoded, ownEncoded) {
+		t.Fatal("codec definitions were changed by decoded messages")
+	}
+}
+
+// regression: structures of empty maps had no definitions in the header
+func TestEncodeEmptyMapOfStructures(t *testing.T) {
+
+	type catalog struct {
+		Products map[string]ProductVal
+	}
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(catalog{Products: map[string]ProductVal{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded catalog
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Products == nil || len(decoded.Products) != 0 {
+		t.Fatalf("unexpected products %v", decoded.Products)
+	}
+}
+
+func TestCanonicalDataOnly(t *testing.T) {
+
+	type first struct{ A, B int }
+	type second struct{ C, D int }
+
+	// sender and receiver registered first under the id, which canonical messages give to second
+	sender := newCanonicalCodec(t)
+	receiver := newTestCodec(t, binary.LittleEndian)
+
+	for _, c := range []*codec{sender, receiver} {
+		_, err := c.Marshal(first{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value := second{3, 4}
+
+	encoded, err := NewEncodeContext(sender).EncodeCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := NewEncodeContext(sender).EncodeFullCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(encoded, full) {
+		t.Fatal("canonical data only message differs from the full one")
+	}
+
+	var out second
+	err = receiver.Unmarshal(encoded, &out)
+	if err != nil || out != value {
+		t.Fatalf("decoded %+v, %v", out, err)
+	}
+}
+
+func TestCanonicalDefinitionsScoped(t *testing.T) {
+
+	// sender and receiver share registrations, canonical messages number structures on their own
+	c := newTestCodec(t, binary.LittleEndian)
+
+	own := newTestStruct(2)
+
+	_, err := c.Marshal(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataOnly, err := NewEncodeContext(c).EncodeCopy(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(c)
+
+	for _, value := range []interface{}{newCanonicalStruct(), MapValStruct{5, "five"}} {
+
+		encoded, err := newCanonicalCodec(t).Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := reflect.New(reflect.TypeOf(value))
+		err = ctx.Decode(out.Interface(), encoded)
+		if err != nil || !reflect.DeepEqual(value, out.Elem().Interface()) {
+			t.Fatalf("%T: decoded %+v, %v", value, out.Elem().Interface(), err)
+		}
+
+		if len(ctx.overrides) != 0 {
+			t.Fatalf("%T: canonical definitions are kept by the context", value)
+		}
+
+		// ids of the canonical message don't change the following data only one
+		var decoded TestStruct
+		err = ctx.Decode(&decoded, dataOnly)
+		if err != nil {
+			t.Fatalf("%T: %v", value, err)
+		}
+
+		if !reflect.DeepEqual(own, decoded) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", own, decoded)
+		}
+	}
+}
+
+func TestCanonicalMapKeyOrder(t *testing.T) {
+
+	type pair struct {
+		A int
+		B string
+	}
+
+	type pointing struct {
+		P *int
+	}
+
+	one, two := 1, 2
+	nan := math.NaN()
+
+	cases := []struct {
+		a, b interface{}
+		cmp  int
+	}{
+		{nan, 1.0, -1},
+		{math.Inf(-1), nan, 1},
+		{nan, nan, 0},
+		{-1.5, 2.5, -1},
+		{pair{1, "b"}, pair{1, "a"}, 1},
+		{pair{0, "z"}, pair{1, "a"}, -1},
+		{[2]int{1, 2}, [2]int{1, 3}, -1},
+		{pointing{&two}, pointing{&one}, 1},
+		{pointing{nil}, pointing{&one}, -1},
+		{"a", 1, 1},
+		{false, true, -1},
+	}
+
+	for i, tc := range cases {
+
+		// keys of interface maps are compared through interfaces
+		a := reflect.ValueOf(&tc.a).Elem()
+		b := reflect.ValueOf(&tc.b).Elem()
+
+		if cmp := compareValues(a, b); cmp != tc.cmp {
+			t.Fatalf("case %d: %v compared to %v is %d, expected %d", i, tc.a, tc.b, cmp, tc.cmp)
+		}
+
+		if cmp := compareValues(b, a); cmp != -tc.cmp {
+			t.Fatalf("case %d: %v compared to %v is %d, expected %d", i, tc.b, tc.a, cmp, -tc.cmp)
+		}
+	}
+}
+
+func TestCanonicalNaNKeys(t *testing.T) {
+
+	// NaN keys are never equal, so a map could have several of them
+	value := map[float64]int{math.NaN(): 1, math.NaN(): 2, math.NaN(): 3}
+	for i := 0; i < 20; i++ {
+		value[float64(i)-10] = i
+	}
+
+	c := newCanonicalCodec(t)
+
+	first, err := c.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		encoded, err := c.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(first, encoded) {
+			t.Fatalf("encoding %d differs", i)
+		}
+	}
+}
@@ -2,20 +2,36 @@ package codec
 
 import (
 	"encoding/binary"
-	"errors"
-	"fmt"
-	"github.com/dot5enko/transbin/utils"
 	"reflect"
+	"sync"
+	"sync/atomic"
 )
 
 const defaultBufferSize int = 512
 const internalTypesCount uint16 = 26
 
+// id of the first registered structure
+const firstStructId uint16 = internalTypesCount + 2
+
+// codec is safe for concurrent use by multiple encode and decode contexts.
+// known types are kept in an immutable registry snapshot, so lookups never lock,
+// while registration of new types is serialized by registerLock
 type codec struct {
 	typesCount uint16
-	types      map[uint16]*structDefinition
 	order      binary.ByteOrder
-	typeMap    map[string]uint16
+
+	registry     atomic.Value // *type_registry
+	registerLock sync.Mutex
+
+	encoders sync.Pool
+	decoders sync.Pool
+
+	encodeOptions EncodeOptions
+	decodeOptions DecodeOptions
+
+	// compiled structure plans, see plan.go
+	encodePlans sync.Map // reflect.Type -> *structPlan
+	decodePlans sync.Map // registered *structDefinition -> *sync.Map of reflect.Type -> *structPlan
 }
 
 func (c *codec) get_free_ebuffer(initialSize int) encode_buffer {
@@ -31,38 +47,22 @@ func NewCodec(order binary.ByteOrder) (*codec, error) {
 
 	// in order to not interfer with internal types
 
-	result.typesCount = 27
-	result.types = make(map[uint16]*structDefinition)
+	result.typesCount = firstStructId - 1
 	result.order = order
-	result.typeMap = make(map[string]uint16)
+	result.registry.Store(newTypeRegistry())
 
-	return result, nil
-}
+	// byte order is recorded in the header, so any codec could read the messages
+	result.encodeOptions = EncodeOptions{Header: true}
+	result.decodeOptions = DefaultDecodeOptions
 
-func (c codec) cacheReflectionData(typeId uint16, t reflect.Type) error {
-	tData, ok := c.types[typeId]
-	if !ok {
-		return errors.New("unable to found a type declaration in codec")
+	result.encoders.New = func() interface{} {
+		return NewEncodeContext(result)
 	}
-
-	if tData.Offsets > 0 {
-		return nil
-	}
-
-	for i := 0; i < int(tData.FieldCount); i++ {
-		f := &tData.Fields[i]
-
-		refField, found := t.FieldByName(f.Name)
-
-		if !found {
-			return errors.New(fmt.Sprintf("field %s not found", f.Name))
-		}
-
-		f.Offset = refField.Offset
+	result.decoders.New = func() interface{} {
+		return NewDecodeContext(result)
 	}
 
-	tData.Offsets = 1
-	return nil
+	return result, nil
 }
 
 func unrollPrt(p reflect.Type) reflect.Type {
@@ -76,7 +76,7 @@ func unrollPrt(p reflect.Type) reflect.Type {
 
 	return p
 }
-func (c codec) getType(p reflect.Type) (uint16, error) {
+func (c *codec) getType(p reflect.Type) (uint16, error) {
 
 	p = unrollPrt(p)
 
@@ -85,13 +85,13 @@ func (c codec) getType(p reflect.Type) (uint16, error) {
 	switch reflect.Kind(t) {
 
 	case reflect.Struct:
-		tref, ok := c.typeMap[getTypeCode(p)]
-
-		if !ok {
-			return 0, utils.Error("Unable to found a size for type %d", t)
+		// structures met first inside of interfaces and maps are registered here
+		def, err := c.registerStructure(p)
+		if err != nil {
+			return 0, err
 		}
 
-		return tref, nil
+		return def.Id, nil
 	case reflect.Slice:
 		t, err := c.getType(p.Elem())
 		if err != nil {
@@ -102,41 +102,51 @@ func (c codec) getType(p reflect.Type) (uint16, error) {
 
 		return t, nil
 
-		//return 0, utils.Error("Unable to detect internal type for %s", p.Kind().String())
 	}
 }
 
-func (c codec) getTypeSize(t uint16) (int, error) {
+func (c *codec) getTypeSize(t uint16) (int, error) {
 
-	if isArrayType(t) {
-		return 2, nil
-	}
-
-	if t > internalTypesCount {
+	if !isArrayType(t) && t > internalTypesCount {
 
-		tref, ok := c.types[t]
+		tref, ok := c.types().byId(t)
 
 		if !ok {
-			return 0, utils.Error("Unable to found a size for type %d", t)
+			return 0, errorf(ErrUnknownType, "no definition for type %d", t)
 		}
 
 		return tref.Size, nil
-	} else {
-		switch reflect.Kind(t) {
-		case reflect.Bool, reflect.Uint8:
-			return 1, nil
-		case reflect.String, reflect.Slice: // reference types
-			return 2, nil
-		case reflect.Uint16:
-			return 2, nil
-		case reflect.Float32, reflect.Int32, reflect.Uint, reflect.Int, reflect.Uint32, reflect.Uintptr, reflect.Interface:
-			return 4, nil
-		case reflect.Float64, reflect.Int64, reflect.Uint64:
-			return 8, nil
-		case reflect.Map:
-			return 2 /* reference to data id*/ + 2 /*element type*/ + 2 /*elements count*/, nil
-		default:
-			return 0, fmt.Errorf("Unable to get a type length for type %s: %d", reflect.Kind(t).String(), t)
-		}
+	}
+
+	return kindSize(t)
+}
+
+// typeSize is getTypeSize, named as the one of decode contexts for decode plans
+func (c *codec) typeSize(t uint16) (int, error) {
+	return c.getTypeSize(t)
+}
+
+// kindSize returns size of arrays and internal types, which don't need definitions
+func kindSize(t uint16) (int, error) {
+
+	if isArrayType(t) {
+		return 2, nil
+	}
+
+	switch reflect.Kind(t) {
+	case reflect.Bool, reflect.Uint8:
+		return 1, nil
+	case reflect.String, reflect.Slice: // reference types
+		return 2, nil
+	case reflect.Uint16:
+		return 2, nil
+	case reflect.Float32, reflect.Int32, reflect.Uint, reflect.Int, reflect.Uint32, reflect.Uintptr, reflect.Interface, reflect.Ptr:
+		return 4, nil
+	case reflect.Float64, reflect.Int64, reflect.Uint64:
+		return 8, nil
+	case reflect.Map:
+		return 2 /* reference to data id*/ + 2 /*element type*/ + 2 /*elements count*/, nil
+	default:
+		return 0, errorf(ErrUnknownType, "no size for type %s: %d", reflect.Kind(t).String(), t)
 	}
 }
@@ -0,0 +1,455 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// structures of the "nested" benchmark shape
+type ProductVal struct {
+	Name  string
+	Price float64
+}
+
+type MapValStruct struct {
+	Int  int
+	Name string
+}
+
+type NStruct struct {
+	Nint    int
+	Nstring int
+	N3      int
+	N5      int
+	Floa    float64
+	Fl2     float64
+	Product ProductVal
+}
+
+type TestStruct struct {
+	Id           int
+	Value        float32
+	NestedStruct []NStruct
+	MapVal       MapValStruct
+	StrVal       string
+}
+
+func newTestStruct(nested int) TestStruct {
+
+	var result TestStruct
+
+	result.Id = 49
+	result.Value = 32720.2383
+	result.StrVal = "holaAmigo grande!"
+
+	result.MapVal.Int = 5
+	result.MapVal.Name = "serhii"
+
+	result.NestedStruct = make([]NStruct, nested)
+
+	for i := 0; i < nested; i++ {
+		result.NestedStruct[i].Nint = 99
+		result.NestedStruct[i].Nstring = 38
+		result.NestedStruct[i].N3 = 33
+		result.NestedStruct[i].N5 = 55
+		result.NestedStruct[i].Floa = 28973892.3833
+		result.NestedStruct[i].Fl2 = 99.98765432
+
+		result.NestedStruct[i].Product.Price = 10.95
+		result.NestedStruct[i].Product.Name = "json binary self describing proto"
+	}
+
+	return result
+}
+
+type mixedStruct struct {
+	I32     int32
+	F32     float32
+	Floats  []float64
+	Strings []string
+	Attrs   map[string]interface{}
+	Counts  map[string]int
+	Any     interface{}
+	Items   []ProductVal
+}
+
+func newTestCodec(t testing.TB, order binary.ByteOrder) *codec {
+	c, err := NewCodec(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func randomString(r *rand.Rand) string {
+	b := make([]byte, r.Intn(40))
+	for i := range b {
+		b[i] = byte(r.Intn(256))
+	}
+	return string(b)
+}
+
+func randomTestStruct(r *rand.Rand) TestStruct {
+
+	var result TestStruct
+
+	// int fields are transferred as 4 bytes
+	result.Id = int(r.Int31()) - r.Intn(1<<30)
+	result.Value = r.Float32()
+	result.StrVal = randomString(r)
+	result.MapVal.Int = int(r.Int31())
+	result.MapVal.Name = randomString(r)
+
+	result.NestedStruct = make([]NStruct, r.Intn(20))
+	for i := range result.NestedStruct {
+		n := &result.NestedStruct[i]
+		n.Nint = int(r.Int31())
+		n.Nstring = -int(r.Int31())
+		n.N3 = r.Intn(100)
+		n.N5 = r.Intn(100000)
+		n.Floa = r.NormFloat64() * 1e6
+		n.Fl2 = r.Float64()
+		n.Product.Name = randomString(r)
+		n.Product.Price = r.ExpFloat64()
+	}
+
+	return result
+}
+
+func randomMixedStruct(r *rand.Rand) mixedStruct {
+
+	var result mixedStruct
+
+	result.I32 = r.Int31() - r.Int31()
+	result.F32 = float32(r.NormFloat64())
+
+	result.Floats = make([]float64, r.Intn(30))
+	for i := range result.Floats {
+		result.Floats[i] = r.NormFloat64()
+	}
+
+	result.Strings = make([]string, r.Intn(10))
+	for i := range result.Strings {
+		result.Strings[i] = randomString(r)
+	}
+
+	result.Attrs = make(map[string]interface{})
+	result.Counts = make(map[string]int)
+	for i := r.Intn(10); i > 0; i-- {
+		if r.Intn(2) == 0 {
+			result.Attrs[randomString(r)] = r.NormFloat64()
+		} else {
+			result.Attrs[randomString(r)] = randomString(r)
+		}
+		result.Counts[randomString(r)] = int(r.Int31())
+	}
+
+	switch r.Intn(3) {
+	case 0:
+		result.Any = int(r.Int31())
+	case 1:
+		result.Any = r.NormFloat64()
+	default:
+		result.Any = randomString(r)
+	}
+
+	result.Items = make([]ProductVal, r.Intn(5))
+	for i := range result.Items {
+		result.Items[i] = ProductVal{randomString(r), r.Float64()}
+	}
+
+	return result
+}
+
+func TestRoundTripBenchmarkStruct(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	original := newTestStruct(10)
+
+	encoded, err := c.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded TestStruct
+	err = c.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(original, decoded) {
+		t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", original, decoded)
+	}
+}
+
+func TestRoundTripRandomValues(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		encoder := newTestCodec(t, order)
+		enc := NewEncodeContext(encoder)
+
+		for i := 0; i < 500; i++ {
+
+			// decode with a fresh codec, so structure definitions come from the message
+			decoder := newTestCodec(t, binary.LittleEndian)
+
+			original := randomTestStruct(r)
+			encoded, err := enc.EncodeFullCopy(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded TestStruct
+			err = decoder.Unmarshal(encoded, &decoded)
+			if err != nil {
+				t.Fatalf("%s: %v", order, err)
+			}
+
+			if len(original.NestedStruct) == 0 {
+				original.NestedStruct = []NStruct{}
+			}
+
+			if !reflect.DeepEqual(original, decoded) {
+				t.Fatalf("%s: decoded value differs\nwant %+v\ngot  %+v", order, original, decoded)
+			}
+
+			mixed := randomMixedStruct(r)
+			encoded, err = enc.EncodeFullCopy(mixed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decodedMixed mixedStruct
+			err = decoder.Unmarshal(encoded, &decodedMixed)
+			if err != nil {
+				t.Fatalf("%s: %v", order, err)
+			}
+
+			if len(mixed.Floats) == 0 {
+				mixed.Floats = []float64{}
+			}
+			if len(mixed.Strings) == 0 {
+				mixed.Strings = []string{}
+			}
+			if len(mixed.Items) == 0 {
+				mixed.Items = []ProductVal{}
+			}
+			// decoded interfaces hold int64 values
+			if v, ok := mixed.Any.(int); ok {
+				mixed.Any = int64(v)
+			}
+
+			if !reflect.DeepEqual(mixed, decodedMixed) {
+				t.Fatalf("%s: decoded value differs\nwant %+v\ngot  %+v", order, mixed, decodedMixed)
+			}
+		}
+	}
+}
+
+func TestRoundTripDataOnly(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	ctx := NewEncodeContext(c)
+
+	r := rand.New(rand.NewSource(2))
+
+	// first message brings structure definitions
+	_, err := ctx.EncodeFull(randomTestStruct(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+
+		original := randomTestStruct(r)
+		encoded, err := ctx.EncodeCopy(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded TestStruct
+		err = c.Unmarshal(encoded, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(original.NestedStruct) == 0 {
+			original.NestedStruct = []NStruct{}
+		}
+
+		if !reflect.DeepEqual(original, decoded) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", original, decoded)
+		}
+	}
+}
+
+// regression: slices of internal types were listed as structures in the header
+func TestEncodeFullNumericSlice(t *testing.T) {
+
+	type floats struct {
+		Values []float64
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(floats{[]float64{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded floats
+	err = c.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded.Values, []float64{1, 2, 3}) {
+		t.Fatalf("got %v", decoded.Values)
+	}
+}
+
+// regression: growing references buffer while writing a slice lost reserved area
+func TestEncodeReferencesGrowth(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	original := newTestStruct(200)
+	for i := range original.NestedStruct {
+		original.NestedStruct[i].Product.Name = randomString(rand.New(rand.NewSource(int64(i))))
+	}
+
+	encoded, err := c.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded TestStruct
+	err = c.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(original, decoded) {
+		t.Fatal("decoded value differs")
+	}
+}
+
+// regression: nested structure registered before its parent was written after it,
+// and nested structures of empty slices were missing in the header
+func TestStructureDefinitionsOrder(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	_, err := c.Marshal(ProductVal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []interface{}{NStruct{Nint: 5}, TestStruct{Id: 3}} {
+
+		encoded, err := c.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoder := newTestCodec(t, binary.LittleEndian)
+
+		out := reflect.New(reflect.TypeOf(v))
+		err = decoder.Unmarshal(encoded, out.Interface())
+		if err != nil {
+			t.Fatalf("%T: %v", v, err)
+		}
+	}
+}
+
+// regression: all anonymous structures shared a single definition
+func TestAnonymousStructures(t *testing.T) {
+
+	type wrapper struct {
+		A struct{ X int }
+		B struct {
+			Y string
+			Z float64
+		}
+	}
+
+	original := wrapper{}
+	original.A.X = 4
+	original.B.Y = "y"
+	original.B.Z = 0.5
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded wrapper
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded != original {
+		t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", original, decoded)
+	}
+}
+
+func TestAppendEncodeRetained(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	ctx := NewEncodeContext(c)
+
+	first, second := newTestStruct(2), newTestStruct(4)
+	second.StrVal = "second message"
+
+	expectedFirst, err := NewEncodeContext(c).EncodeFullCopy(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedData, err := NewEncodeContext(c).EncodeCopy(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := []byte("frame:")
+
+	kept, err := ctx.AppendEncodeFull(append([]byte(nil), prefix...), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next call reuses context buffers, results of both calls are kept
+	data, err := ctx.AppendEncode(nil, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(kept, append(append([]byte(nil), prefix...), expectedFirst...)) {
+		t.Fatal("result of AppendEncodeFull changed after the next call")
+	}
+
+	if !bytes.Equal(data, expectedData) {
+		t.Fatal("AppendEncode result differs from EncodeCopy")
+	}
+
+	// results decode to the values
+	var out TestStruct
+	err = c.Unmarshal(kept[len(prefix):], &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(first, out) {
+		t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", first, out)
+	}
+}
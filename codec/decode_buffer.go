@@ -10,6 +10,9 @@ type decode_buffer struct {
 
 	pos int
 
+	// offset of data in the whole message, used for error reporting
+	base int
+
 	states    []BufferState
 	statesPos int
 
@@ -31,17 +34,37 @@ func NewDecodeBuffer(order binary.ByteOrder) *decode_buffer {
 }
 
 func (this *decode_buffer) Reset() {
+	this.allocator.data = nil
+	this.pos = 0
 }
 
-func (this decode_buffer) InitBranch(data []byte) decode_buffer {
+// InitBranch returns a buffer reading data, which starts at offset of the whole message
+func (this decode_buffer) InitBranch(data []byte, offset int) decode_buffer {
 
 	this.Init(data)
+	this.base = offset
 	return this
 }
 
 func (this *decode_buffer) Init(b []byte) {
 	this.allocator.data = b
 	this.pos = 0
+	this.base = 0
+}
+
+// Offset returns current read position relative to the start of the message
+func (this *decode_buffer) Offset() int {
+	return this.base + this.pos
+}
+
+// ensure checks that n more bytes could be read
+func (this *decode_buffer) ensure(n int) error {
+	left := len(this.allocator.data) - this.pos
+	if n < 0 || left < n {
+		return &UnexpectedEOFError{Offset: this.Offset(), Need: n, Have: left}
+	}
+
+	return nil
 }
 
 func (this *decode_buffer) GotoPos(pos int) {
@@ -50,26 +73,46 @@ func (this *decode_buffer) GotoPos(pos int) {
 
 func (this *decode_buffer) ReadByte() (n byte, err error) {
 
+	if err = this.ensure(1); err != nil {
+		return
+	}
+
 	n = this.allocator.data[this.pos]
 	this.pos++
 
 	return
 }
 
+// Read reads exactly len(p) bytes
 func (this *decode_buffer) Read(p []byte) (n int, err error) {
 
+	if err = this.ensure(len(p)); err != nil {
+		return
+	}
+
 	n = copy(p, this.allocator.data[this.pos:])
 	this.pos += n
 
 	return
 }
 
-func (this *decode_buffer) Next(i int) {
+func (this *decode_buffer) Next(i int) error {
+
+	if err := this.ensure(i); err != nil {
+		return err
+	}
+
 	this.pos += i
+
+	return nil
 }
 
 func (this *decode_buffer) ReadUint8(dest *uint8) error {
 
+	if err := this.ensure(1); err != nil {
+		return err
+	}
+
 	*dest = this.allocator.data[this.pos]
 	this.pos++
 
@@ -77,14 +120,23 @@ func (this *decode_buffer) ReadUint8(dest *uint8) error {
 }
 
 func (this *decode_buffer) ReadUint16(dest *uint16) (err error) {
+
+	if err = this.ensure(2); err != nil {
+		return
+	}
+
 	*dest = this.order.Uint16(this.allocator.data[this.pos:])
 	this.pos += 2
 
-	// todo check bounds
 	return nil
 }
 
 func (this *decode_buffer) ReadInt32(data *int32) error {
+
+	if err := this.ensure(4); err != nil {
+		return err
+	}
+
 	*data = int32(this.order.Uint32(this.allocator.data[this.pos:]))
 	this.pos += 4
 
@@ -92,6 +144,11 @@ func (this *decode_buffer) ReadInt32(data *int32) error {
 }
 
 func (this *decode_buffer) ReadFloat32(data *float32) error {
+
+	if err := this.ensure(4); err != nil {
+		return err
+	}
+
 	*data = math.Float32frombits(this.order.Uint32(this.allocator.data[this.pos:]))
 	this.pos += 4
 
@@ -99,6 +156,11 @@ func (this *decode_buffer) ReadFloat32(data *float32) error {
 }
 
 func (this *decode_buffer) ReadFloat64(data *float64) error {
+
+	if err := this.ensure(8); err != nil {
+		return err
+	}
+
 	*data = math.Float64frombits(this.order.Uint64(this.allocator.data[this.pos:]))
 	this.pos += 8
 
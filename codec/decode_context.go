@@ -1,11 +1,11 @@
 package codec
 
 import (
-	"errors"
+	"encoding/binary"
 	"fmt"
-	"github.com/dot5enko/transbin/utils"
 	"reflect"
-	"runtime"
+	"strconv"
+	"unsafe"
 )
 
 type decode_context struct {
@@ -22,6 +22,29 @@ type decode_context struct {
 		uint16val  uint16
 		nameReader [255]byte
 	}
+
+	options DecodeOptions
+
+	// resources spent on the current message
+	depth     int
+	allocated int
+
+	// header and ids of structures defined by the current message, in wire order
+	header       messageHeader
+	hasHeader    bool
+	messageTypes []uint16
+
+	// definitions received by the context, which are not registered or differ from registered ones
+	overrides map[uint16]*structDefinition
+
+	// definitions of the current canonical message, its ids mean nothing to other messages
+	local map[uint16]*structDefinition
+
+	// plans compiled with overrides or local definitions, dropped when they change
+	plans map[*structDefinition]map[reflect.Type]*structPlan
+
+	// pointers decoded from the current message by reference ids
+	pointers map[uint16]reflect.Value
 }
 
 func NewDecodeContext(global *codec) *decode_context {
@@ -30,39 +53,103 @@ func NewDecodeContext(global *codec) *decode_context {
 	result.references = new_references_reader(global.order)
 	result.buffer = global.get_free_dbuffer()
 	result.global = global
+	result.options = global.decodeOptions
 
 	return result
 }
 
+func (ctx *decode_context) setOrder(order binary.ByteOrder) {
+	ctx.buffer.order = order
+	ctx.references.buffer.order = order
+}
+
 func (ctx *decode_context) Reset() {
+	ctx.buffer.Reset()
+	ctx.references.Reset()
+	ctx.depth = 0
+	ctx.allocated = 0
 
+	for id := range ctx.overrides {
+		delete(ctx.overrides, id)
+	}
+	for id := range ctx.local {
+		delete(ctx.local, id)
+	}
+	ctx.plans = nil
 }
 
 func (ctx *decode_context) readArrayElement(buffer *decode_buffer, elementType uint16, out reflect.Value) error {
 
-	buffer.ReadUint16(&ctx.dataBuffer.uint16val)
-	arrayData, length, err := ctx.references.Get(uint64(ctx.dataBuffer.uint16val))
+	typeSize, err := ctx.typeSize(elementType)
+	if err != nil {
+		return err
+	}
+
+	return ctx.readArray(buffer, elementType, typeSize, out)
+}
+
+// readArray reads array of elements typeSize bytes each
+func (ctx *decode_context) readArray(buffer *decode_buffer, elementType uint16, typeSize int, out reflect.Value) error {
+
+	err := buffer.ReadUint16(&ctx.dataBuffer.uint16val)
 	if err != nil {
 		return err
 	}
 
-	typeSize, err := ctx.global.getTypeSize(elementType)
+	arrayData, offset, err := ctx.references.Get(uint64(ctx.dataBuffer.uint16val))
 	if err != nil {
 		return err
 	}
 
-	var items int = int(length) / typeSize
+	if out.Kind() != reflect.Slice || !out.CanSet() {
+		return errorf(ErrTypeMismatch, "unable to decode array to %s", out.Type())
+	}
+
+	var items int
+	if typeSize > 0 {
+		if len(arrayData)%typeSize != 0 {
+			return errorf(ErrMalformed, "array data length %d is not a multiple of element size %d", len(arrayData), typeSize)
+		}
+		items = len(arrayData) / typeSize
+	}
+
+	err = ctx.checkSliceLength(items)
+	if err == nil {
+		err = ctx.allocate(out.Type(), items*int(out.Type().Elem().Size()))
+	}
+	if err != nil {
+		return err
+	}
 
-	// check if out is not a slice already
 	arrayResult := reflect.MakeSlice(out.Type(), items, items)
 
+	curBuf := buffer.InitBranch(arrayData, offset)
+
+	// numbers in host order and bytes in any order are copied as they are
+	if items > 0 && (curBuf.order == nativeOrder || typeSize == 1) && bulkElementSize(elementType, out.Type().Elem().Kind()) == typeSize {
+
+		// elements are accounted as if they were read one by one
+		err = ctx.enter(&curBuf, elementType)
+		if err != nil {
+			return withPathElement(err, "0")
+		}
+		ctx.depth--
+
+		copy(sliceBytes(arrayResult, typeSize), arrayData)
+
+		out.Set(arrayResult)
+
+		return nil
+	}
+
 	fakeField := codecStructField{}
 	fakeField.Type = elementType
 
-	curBuf := buffer.InitBranch(arrayData)
-
 	for i := 0; i < items; i++ {
-		ctx.readFieldData(&curBuf, fakeField, arrayResult.Index(i))
+		err = ctx.readFieldData(&curBuf, fakeField, arrayResult.Index(i))
+		if err != nil {
+			return withPathElement(err, strconv.Itoa(i))
+		}
 	}
 
 	out.Set(arrayResult)
@@ -70,30 +157,50 @@ func (ctx *decode_context) readArrayElement(buffer *decode_buffer, elementType u
 	return nil
 }
 
-func (c *decode_context) readMapField(buffer *decode_buffer, interfaceElemType uint16, keyType uint16, refBytes []byte, out reflect.Value) error {
+func (c *decode_context) readMapField(buffer *decode_buffer, interfaceElemType uint16, keyType uint16, refBytes []byte, offset int, out reflect.Value) error {
 
 	dataLen := len(refBytes)
 
-	newMap := reflect.MakeMap(out.Type())
+	if out.Kind() != reflect.Map || !out.CanSet() {
+		return errorf(ErrTypeMismatch, "unable to decode map to %s", out.Type())
+	}
 
 	// type of interface element
-	elemSize, err := c.global.getTypeSize(interfaceElemType)
+	elemSize, err := c.typeSize(interfaceElemType)
 	if err != nil {
 		return err
 	}
 
-	keySize, err := c.global.getTypeSize(keyType)
+	keySize, err := c.typeSize(keyType)
+	if err != nil {
+		return err
+	}
 	elemSize += keySize
 
+	if elemSize == 0 || dataLen%elemSize != 0 {
+		return errorf(ErrMalformed, "map data length %d doesn't match entry size %d", dataLen, elemSize)
+	}
+
 	elems := dataLen / elemSize
 
+	err = c.checkSliceLength(elems)
+	if err == nil {
+		// keys and values are staged in slices before getting to the map
+		err = c.allocate(out.Type(), 2*elems*int(out.Type().Key().Size()+out.Type().Elem().Size()))
+	}
+	if err != nil {
+		return err
+	}
+
+	newMap := reflect.MakeMap(out.Type())
+
 	values := reflect.MakeSlice(reflect.SliceOf(out.Type().Elem()), elems, elems)
 	keys := reflect.MakeSlice(reflect.SliceOf(out.Type().Key()), elems, elems)
 
 	fakeKeyField := codecStructField{}
 	fakeKeyField.Type = keyType
 
-	subBuffer := buffer.InitBranch(refBytes)
+	subBuffer := buffer.InitBranch(refBytes, offset)
 
 	for i := 0; i < elems; i++ {
 		// read key
@@ -101,14 +208,14 @@ func (c *decode_context) readMapField(buffer *decode_buffer, interfaceElemType u
 		err := c.readFieldData(&subBuffer, fakeKeyField, keys.Index(i))
 
 		if err != nil {
-			return err
+			return withPathElement(err, fmt.Sprintf("#%d", i))
 		}
 
 		// read value
 		fakeKeyField.Type = interfaceElemType
 		err = c.readFieldData(&subBuffer, fakeKeyField, values.Index(i))
 		if err != nil {
-			return err
+			return withPathElement(err, toPathElement(keys.Index(i).Interface()))
 		}
 
 		newMap.SetMapIndex(keys.Index(i), values.Index(i))
@@ -131,15 +238,18 @@ func (c *decode_context) readStructFieldData() (sf codecStructField, err error)
 		return
 	}
 
-	readed, _ := c.buffer.Read(c.dataBuffer.nameReader[:sf.NameLength])
+	readed, err := c.buffer.Read(c.dataBuffer.nameReader[:sf.NameLength])
+	if err != nil {
+		return
+	}
 	if readed != int(sf.NameLength) {
-		return sf, errors.New("Read wrong amount of data when reading structure's field name")
+		return sf, errorf(ErrMalformed, "read %d bytes of %d bytes long field name", readed, sf.NameLength)
 	}
 
 	sf.Name = string(c.dataBuffer.nameReader[:sf.NameLength])
 
 	// calc size in struct
-	sf.Size, err = c.global.getTypeSize(sf.Type)
+	sf.Size, err = c.typeSize(sf.Type)
 
 	return
 
@@ -148,103 +258,150 @@ func (c *decode_context) readStructFieldData() (sf codecStructField, err error)
 // returns struct header size
 func (c *decode_context) tryDecodeStructure() (int, error) {
 
-	headerSize := 0
+	start := c.buffer.pos
 
 	// read number of types
 	nTypes, err := c.buffer.ReadByte()
 	if err != nil {
-		return headerSize, err
+		return c.buffer.pos - start, err
 	}
 
-	headerSize += 1
+	err = c.checkTypes(int(nTypes))
+	if err != nil {
+		return c.buffer.pos - start, err
+	}
 
 	for i := 0; i < int(nTypes); i++ {
 
-		var typeDef structDefinition
-		err = c.buffer.ReadUint16(&typeDef.Id)
+		var typeId uint16
+		var fieldCount uint8
+
+		err = c.buffer.ReadUint16(&typeId)
+		if err != nil {
+			return c.buffer.pos - start, err
+		}
+
+		c.messageTypes = append(c.messageTypes, typeId)
 
+		fieldCount, err = c.buffer.ReadByte()
 		if err != nil {
-			return headerSize, err
+			return c.buffer.pos - start, err
 		}
-		headerSize += 2
 
-		typeDef.FieldCount, err = c.buffer.ReadByte()
+		err = c.checkFields(int(fieldCount))
 		if err != nil {
-			return headerSize, err
+			return c.buffer.pos - start, err
 		}
-		headerSize += 1
 
-		skip := false
-		if _, ok := c.global.types[typeDef.Id]; ok {
-			// skip current structure, we already have it
+		// known structures are compared in place, so definition is allocated only for new ones
+		fieldsStart := c.buffer.pos
+
+		if known, ok := c.definition(typeId); ok {
+
+			same, err := c.sameFields(known, fieldCount)
+			if err != nil {
+				return c.buffer.pos - start, err
+			}
+
+			if same {
+				continue
+			}
+
+			c.buffer.GotoPos(fieldsStart)
+		}
 
-			for j := 0; j < int(typeDef.FieldCount); j++ {
-				c.buffer.Next(2)
+		typeDef := &structDefinition{Id: typeId, FieldCount: fieldCount}
+		typeDef.Fields = make([]codecStructField, typeDef.FieldCount)
 
-				nameLength, _ := c.buffer.ReadByte()
-				// name and type
-				headerSize += 3
-				headerSize += int(nameLength)
+		for j := 0; j < int(typeDef.FieldCount); j++ {
 
-				c.buffer.Next(int(nameLength))
+			typeDef.Fields[j], err = c.readStructFieldData()
+			if err != nil {
+				return c.buffer.pos - start, err
 			}
 
-			skip = true
+			typeDef.Size += typeDef.Fields[j].Size
 		}
 
-		if !skip {
+		err = c.define(typeDef)
+		if err != nil {
+			return c.buffer.pos - start, err
+		}
+	}
 
-			typeDef.Fields = make([]codecStructField, typeDef.FieldCount)
+	return c.buffer.pos - start, nil
+}
 
-			for j := 0; j < int(typeDef.FieldCount); j++ {
+// sameFields reads fields of a definition and compares them with known ones
+func (c *decode_context) sameFields(known *structDefinition, fieldCount uint8) (bool, error) {
 
-				typeDef.Fields[j], err = c.readStructFieldData()
-				if err != nil {
-					return headerSize, err
-				}
+	same := known.FieldCount == fieldCount
 
-				// type and nameLength
-				headerSize += 3
-				headerSize += int(typeDef.Fields[j].NameLength)
+	for j := 0; j < int(fieldCount); j++ {
 
-				typeDef.Size += typeDef.Fields[j].Size
-			}
+		err := c.buffer.ReadUint16(&c.dataBuffer.uint16val)
+		if err != nil {
+			return false, err
+		}
 
-			c.global.types[typeDef.Id] = &typeDef
+		nameLength, err := c.buffer.ReadByte()
+		if err != nil {
+			return false, err
 		}
-	}
 
-	return headerSize, nil
+		name := c.dataBuffer.nameReader[:nameLength]
+
+		readed, err := c.buffer.Read(name)
+		if err != nil {
+			return false, err
+		}
+		if readed != int(nameLength) {
+			return false, errorf(ErrMalformed, "read %d bytes of %d bytes long field name", readed, nameLength)
+		}
+
+		if !same {
+			continue
+		}
+
+		f := &known.Fields[j]
+
+		// sizes of nested structures could change with their definitions
+		size, _ := c.typeSize(c.dataBuffer.uint16val)
 
+		same = f.Type == c.dataBuffer.uint16val && f.Name == string(name) && f.Size == size
+	}
+
+	return same, nil
 }
 
+// Decode decodes input into out, which should be a non nil pointer.
+// errors caused by input are returned as *DecodeError
 func (c *decode_context) Decode(out interface{}, input []byte) error {
 
-	c.buffer.Init(input)
-
-	headerSize, err := c.tryDecodeStructure()
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errorf(ErrInvalidTarget, "got %s", reflect.TypeOf(out))
+	}
 
+	err := c.decode(v, input)
 	if err != nil {
-		return err
+		return decodeError(err, c.buffer.Offset(), 0)
 	}
 
-	var typeOfElement uint16
-	c.buffer.ReadUint16(&typeOfElement)
+	return nil
+}
 
-	structSize, err := c.global.getTypeSize(typeOfElement)
+func (c *decode_context) decode(v reflect.Value, input []byte) error {
+
+	typeOfElement, err := c.readMessage(input)
 	if err != nil {
 		return err
 	}
 
-	refsOffset := structSize + headerSize + 2 // 2 bytes for struct type
-
-	c.references.Init(input[refsOffset:])
-
 	// todo check if type is same in out interface and binary data given
 
-	v := reflect.ValueOf(out)
-	if v.Kind() != reflect.Ptr {
-		return errors.New(fmt.Sprintf("Not addressable value (%s) provided as out parameter. it should be a pointer to structure", v.Type().Kind().String()))
+	if typeOfElement == uint16(reflect.Ptr) {
+		return c.readRootPointer(v)
 	}
 
 	indirect := reflect.Indirect(v)
@@ -258,9 +415,137 @@ func (c *decode_context) Decode(out interface{}, input []byte) error {
 	//return c.readComplexFieldData(typeOfElement, indirect)
 }
 
+// readMessage reads message header and structure definitions, indexes references
+// and leaves buffer at the start of root element data. returns type of the root element
+func (c *decode_context) readMessage(input []byte) (uint16, error) {
+
+	c.depth = 0
+	c.allocated = 0
+	c.messageTypes = c.messageTypes[:0]
+
+	// definitions of the previous canonical message are dropped with plans using them
+	if len(c.local) > 0 {
+		for id := range c.local {
+			delete(c.local, id)
+		}
+		c.plans = nil
+	}
+
+	if c.pointers == nil {
+		c.pointers = make(map[uint16]reflect.Value)
+	}
+	for id := range c.pointers {
+		delete(c.pointers, id)
+	}
+
+	c.buffer.Init(input)
+
+	header, present, err := c.readMessageHeader(input)
+	if err != nil {
+		return 0, err
+	}
+
+	c.header = header
+	c.hasHeader = present
+
+	// messages with a header are read in their own byte order,
+	// others are expected to be in the codec's one
+	if present {
+		c.setOrder(header.Order)
+	} else {
+		c.setOrder(c.global.order)
+	}
+
+	_, err = c.tryDecodeStructure()
+	if err != nil {
+		return 0, err
+	}
+
+	var typeOfElement uint16
+	err = c.buffer.ReadUint16(&typeOfElement)
+	if err != nil {
+		return 0, err
+	}
+
+	structSize, err := c.typeSize(typeOfElement)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.buffer.ensure(structSize)
+	if err != nil {
+		return 0, err
+	}
+
+	refsOffset := c.buffer.pos + structSize
+
+	err = c.references.Init(input[refsOffset:], refsOffset)
+	if err != nil {
+		return 0, err
+	}
+
+	// data section should not be read beyond its end
+	c.buffer.allocator.data = input[:refsOffset]
+
+	return typeOfElement, nil
+}
+
+// values are never read deeper than this whatever the options say,
+// so decoding of malformed messages can't overflow the goroutine stack
+const maxDecodeDepth = 10000
+
+// depthLimit returns MaxDepth, bounded by maxDecodeDepth
+func (c *decode_context) depthLimit() int {
+
+	if c.options.MaxDepth > 0 && c.options.MaxDepth < maxDecodeDepth {
+		return c.options.MaxDepth
+	}
+
+	return maxDecodeDepth
+}
+
+// enter accounts a value of type t about to be read, callers decrement depth when done
+func (c *decode_context) enter(buffer *decode_buffer, t uint16) error {
+
+	c.depth++
+	if limit := c.depthLimit(); c.depth > limit {
+		c.depth--
+		return decodeError(limitError("depth", c.depth+1, limit), buffer.Offset(), t)
+	}
+
+	return nil
+}
+
 func (c *decode_context) readFieldData(buffer *decode_buffer, field codecStructField, out reflect.Value) error {
 
+	err := c.enter(buffer, field.Type)
+	if err != nil {
+		return err
+	}
+
+	offset := buffer.Offset()
+
+	err = c.readTypedData(buffer, field, out)
+
+	c.depth--
+
+	if err != nil {
+		return decodeError(err, offset, field.Type)
+	}
+
+	return nil
+}
 
+func (c *decode_context) readTypedData(buffer *decode_buffer, field codecStructField, out reflect.Value) error {
+
+	// values written in place of pointers are read into the values they point to
+	if field.Type != uint16(reflect.Ptr) && field.Type != uint16(reflect.Interface) {
+		var err error
+		out, err = c.pointedValue(out)
+		if err != nil {
+			return err
+		}
+	}
 
 	if isArrayType(field.Type) {
 		return c.readArrayElement(buffer, getArrayElementType(field.Type), out)
@@ -271,6 +556,8 @@ func (c *decode_context) readFieldData(buffer *decode_buffer, field codecStructF
 			switch reflect.Kind(field.Type) {
 			case reflect.String, reflect.Map, reflect.Interface:
 				return c.readReferenceFieldData(buffer, field.Type, out)
+			case reflect.Ptr:
+				return c.readPointerFieldData(buffer, out)
 			default:
 				return c.readSimpleFieldData(buffer, field.Type, out)
 			}
@@ -297,48 +584,62 @@ func (c *decode_context) readSimpleFieldData(buffer *decode_buffer, t uint16, ou
 		if tmpVal.CanSet() {
 			val := int64(c.dataBuffer.int32val)
 
-			if tmpVal.Kind() == reflect.Interface {
+			switch tmpVal.Kind() {
+			case reflect.Interface:
 				tmpVal.Set(reflect.ValueOf(val))
-			} else {
-
-
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 				tmpVal.SetInt(val)
-
+			default:
+				return errorf(ErrTypeMismatch, "unable to decode int to %s", tmpVal.Type())
 			}
 		} else {
-			return utils.Error("Cant set value on field of type %d\n", t)
+			return errorf(ErrTypeMismatch, "unable to set unaccessible %s value", tmpVal.Type())
 		}
 
 
 	case reflect.Float64:
-		buffer.ReadFloat64(&c.dataBuffer.float64val)
+		err := buffer.ReadFloat64(&c.dataBuffer.float64val)
+		if err != nil {
+			return err
+		}
+
 		if tmpVal.CanSet() {
 
 			val := float64(c.dataBuffer.float64val)
 
-			if tmpVal.Kind() == reflect.Interface {
+			switch tmpVal.Kind() {
+			case reflect.Interface:
 				tmpVal.Set(reflect.ValueOf(val))
-			} else {
+			case reflect.Float32, reflect.Float64:
 				tmpVal.SetFloat(val)
+			default:
+				return errorf(ErrTypeMismatch, "unable to decode float64 to %s", tmpVal.Type())
 			}
 		} else {
-			return errors.New("unable to set float32 value of unaccessable field")
+			return errorf(ErrTypeMismatch, "unable to set unaccessible %s value", tmpVal.Type())
 		}
 	case reflect.Float32:
 
-		buffer.ReadFloat32(&c.dataBuffer.float32val)
+		err := buffer.ReadFloat32(&c.dataBuffer.float32val)
+		if err != nil {
+			return err
+		}
+
 		if tmpVal.CanSet() {
 
-			if tmpVal.Kind() == reflect.Interface {
+			switch tmpVal.Kind() {
+			case reflect.Interface:
 				tmpVal.Set(reflect.ValueOf(float64(c.dataBuffer.float32val)))
-			} else {
+			case reflect.Float32, reflect.Float64:
 				tmpVal.SetFloat(float64(c.dataBuffer.float32val))
+			default:
+				return errorf(ErrTypeMismatch, "unable to decode float32 to %s", tmpVal.Type())
 			}
 		} else {
-			return errors.New("unable to set float32 value of unaccessable field")
+			return errorf(ErrTypeMismatch, "unable to set unaccessible %s value", tmpVal.Type())
 		}
 	default:
-		return errors.New(fmt.Sprintf("Unable to decode type %", t))
+		return errorf(ErrUnknownType, "unable to decode type %d", t)
 	}
 
 	return nil
@@ -351,64 +652,97 @@ func (c *decode_context) readReferenceFieldData(buffer *decode_buffer, t uint16,
 
 	switch reflect.Kind(t) {
 	case reflect.String:
-		buffer.ReadUint16(&c.dataBuffer.uint16val)
+		err := buffer.ReadUint16(&c.dataBuffer.uint16val)
+		if err != nil {
+			return err
+		}
 
 		refBytes, _, err := c.references.Get(uint64(c.dataBuffer.uint16val))
 		if err != nil {
 			return err
 		}
 
-		if out.Kind() == reflect.Interface {
-			out.Set(reflect.ValueOf(string(refBytes)))
-		} else {
+		if !out.CanSet() || (out.Kind() != reflect.Interface && out.Kind() != reflect.String) {
+			return errorf(ErrTypeMismatch, "unable to decode string to %s", out.Type())
+		}
 
-			runtime.ReadMemStats(&curms)
-			out.SetString(string(refBytes))
+		var str string
 
-			oldMallocs := curms.Mallocs
-			runtime.ReadMemStats(&curms)
-			if oldMallocs != curms.Mallocs {
-				refsC += (curms.Mallocs - oldMallocs)
-				fmt.Printf(" -- put simple field %d mallocs +%d when adding type %s\n", refsC, curms.Mallocs-oldMallocs, out.Type().String())
+		if c.options.ZeroCopyStrings {
+			str = *(*string)(unsafe.Pointer(&refBytes))
+		} else {
+			err = c.allocate(out.Type(), len(refBytes))
+			if err != nil {
+				return err
 			}
 
+			str = string(refBytes)
+		}
+
+		if out.Kind() == reflect.Interface {
+			out.Set(reflect.ValueOf(str))
+		} else {
+			out.SetString(str)
 		}
 	case reflect.Map:
 
 		var elType uint16
 		var keyType uint16
 
-		buffer.ReadUint16(&elType)
-		buffer.ReadUint16(&keyType)
-
-		buffer.ReadUint16(&c.dataBuffer.uint16val)
+		err := buffer.ReadUint16(&elType)
+		if err == nil {
+			err = buffer.ReadUint16(&keyType)
+		}
+		if err == nil {
+			err = buffer.ReadUint16(&c.dataBuffer.uint16val)
+		}
+		if err != nil {
+			return err
+		}
 
-		refBytes, _, err := c.references.Get(uint64(c.dataBuffer.uint16val))
+		refBytes, offset, err := c.references.Get(uint64(c.dataBuffer.uint16val))
 		if err != nil {
 			return err
 		}
-		err = c.readMapField(buffer, elType, keyType, refBytes, out)
+		err = c.readMapField(buffer, elType, keyType, refBytes, offset, out)
 		if err != nil {
 			return err
 		}
 	case reflect.Interface:
 
 		var interfaceType uint16
-		buffer.ReadUint16(&interfaceType)
-		buffer.ReadUint16(&c.dataBuffer.uint16val)
+		err := buffer.ReadUint16(&interfaceType)
+		if err == nil {
+			err = buffer.ReadUint16(&c.dataBuffer.uint16val)
+		}
+		if err != nil {
+			return err
+		}
 
-		refBytes, _, err := c.references.Get(uint64(c.dataBuffer.uint16val))
+		refBytes, offset, err := c.references.Get(uint64(c.dataBuffer.uint16val))
 		if err != nil {
 			return err
 		}
+		// nil interface
+		if interfaceType == 0 {
+			if !out.CanSet() {
+				return errorf(ErrTypeMismatch, "unable to set unaccessible %s value", out.Type())
+			}
+			out.Set(reflect.Zero(out.Type()))
+			return nil
+		}
+
 		fakeField := codecStructField{}
 		fakeField.Type = interfaceType
 
-		refBuffer := buffer.InitBranch(refBytes)
+		refBuffer := buffer.InitBranch(refBytes, offset)
 
-		c.readFieldData(&refBuffer, fakeField, out)
+		err = c.readFieldData(&refBuffer, fakeField, out)
+		if err != nil {
+			return err
+		}
 	default:
-		return utils.Error("Unable to decode referenced type: %s\n", reflect.Kind(t).String())
+		return errorf(ErrUnknownType, "unable to decode referenced type %s", reflect.Kind(t))
 	}
 
 	return nil
@@ -419,31 +753,23 @@ func (c *decode_context) readComplexFieldData(buffer *decode_buffer, t uint16, o
 	refValue := reflect.Indirect(out)
 
 	if refValue.Kind() != reflect.Struct {
-		return utils.Error("cannot decode data to %s", refValue.Kind().String())
+		return errorf(ErrTypeMismatch, "unable to decode structure %d to %s", t, refValue.Kind())
 	}
 
-	tData, ok := c.global.types[t]
-	if !ok {
-		return utils.Error("No structure present in data. dont know how to decode %d type", t)
+	// plans set fields without checking them, structures in unexported fields are refused here
+	if !refValue.CanSet() {
+		return errorf(ErrTypeMismatch, "unable to set unaccessible %s value", refValue.Type())
 	}
 
-	for i := 0; i < int(tData.FieldCount); i++ {
-
-		f := tData.Fields[i]
-
-		fieldObj := refValue.Field(i)
-		if fieldObj.Kind() == reflect.Ptr {
-			if fieldObj.IsNil() {
-				fieldObj.Set(reflect.New(fieldObj.Type().Elem()))
-			}
-		}
-
-		err = c.readFieldData(buffer, f, fieldObj)
+	tData, ok := c.definition(t)
+	if !ok {
+		return errorf(ErrUnknownType, "no definition for structure %d", t)
+	}
 
-		if err != nil {
-			return
-		}
+	plan, err := c.decodePlan(tData, refValue.Type())
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return c.readPlan(buffer, plan, refValue)
 }
@@ -0,0 +1,328 @@
+package codec
+
+import (
+	"reflect"
+	"strconv"
+	"unsafe"
+)
+
+var (
+	dynamicStructType = reflect.TypeOf(map[string]interface{}(nil))
+	dynamicMapType    = reflect.TypeOf(map[interface{}]interface{}(nil))
+	dynamicSliceType  = reflect.TypeOf([]interface{}(nil))
+	bytesType         = reflect.TypeOf([]byte(nil))
+	dynamicStringType = reflect.TypeOf("")
+)
+
+// approximate size of a map entry, used for allocation limits
+const dynamicMapEntrySize = 48
+
+// DecodeDynamic decodes a self describing message without a Go type for it.
+// structures are decoded to map[string]interface{} keyed by field names,
+// slices to []interface{}, byte slices to []byte, maps with string keys to map[string]interface{}
+// and other maps to map[interface{}]interface{}. integers become int64,
+// floating point numbers float64, pointers are decoded as values they point to,
+// shared structures become the same map. message should carry definitions of its structures,
+// unless they are already known to the codec or were received by the context
+func (c *decode_context) DecodeDynamic(input []byte) (interface{}, error) {
+
+	typeOfElement, err := c.readMessage(input)
+	if err != nil {
+		return nil, decodeError(err, c.buffer.Offset(), 0)
+	}
+
+	result, err := c.readDynamicField(c.buffer, typeOfElement)
+	if err != nil {
+		return nil, decodeError(err, c.buffer.Offset(), 0)
+	}
+
+	return result, nil
+}
+
+func (c *decode_context) readDynamicField(buffer *decode_buffer, t uint16) (interface{}, error) {
+
+	err := c.enter(buffer, t)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := buffer.Offset()
+
+	result, err := c.readDynamicValue(buffer, t)
+
+	c.depth--
+
+	if err != nil {
+		return nil, decodeError(err, offset, t)
+	}
+
+	return result, nil
+}
+
+// readDynamicReference reads reference id and returns a buffer for referenced data
+func (c *decode_context) readDynamicReference(buffer *decode_buffer) (decode_buffer, error) {
+
+	var id uint16
+	err := buffer.ReadUint16(&id)
+	if err != nil {
+		return decode_buffer{}, err
+	}
+
+	refBytes, offset, err := c.references.Get(uint64(id))
+	if err != nil {
+		return decode_buffer{}, err
+	}
+
+	return buffer.InitBranch(refBytes, offset), nil
+}
+
+func (c *decode_context) readDynamicValue(buffer *decode_buffer, t uint16) (interface{}, error) {
+
+	if isArrayType(t) {
+		return c.readDynamicArray(buffer, getArrayElementType(t))
+	}
+
+	if t > internalTypesCount {
+		return c.readDynamicStruct(buffer, t, 0)
+	}
+
+	switch reflect.Kind(t) {
+	case reflect.Uint8:
+		var val uint8
+		err := buffer.ReadUint8(&val)
+		return int64(val), err
+	case reflect.Int, reflect.Int32:
+		var val int32
+		err := buffer.ReadInt32(&val)
+		return int64(val), err
+	case reflect.Float32:
+		var val float32
+		err := buffer.ReadFloat32(&val)
+		return float64(val), err
+	case reflect.Float64:
+		var val float64
+		err := buffer.ReadFloat64(&val)
+		return val, err
+	case reflect.String:
+		ref, err := c.readDynamicReference(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		refBytes := ref.allocator.data
+
+		if c.options.ZeroCopyStrings {
+			return *(*string)(unsafe.Pointer(&refBytes)), nil
+		}
+
+		err = c.allocate(dynamicStringType, len(refBytes))
+		if err != nil {
+			return nil, err
+		}
+
+		return string(refBytes), nil
+	case reflect.Interface:
+		var interfaceType uint16
+		err := buffer.ReadUint16(&interfaceType)
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := c.readDynamicReference(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		// nil interface
+		if interfaceType == 0 {
+			return nil, nil
+		}
+
+		return c.readDynamicField(&ref, interfaceType)
+	case reflect.Map:
+		var elType, keyType uint16
+
+		err := buffer.ReadUint16(&elType)
+		if err == nil {
+			err = buffer.ReadUint16(&keyType)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := c.readDynamicReference(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.readDynamicMap(&ref, elType, keyType)
+	case reflect.Ptr:
+		return c.readDynamicPointer(buffer)
+	default:
+		return nil, errorf(ErrUnknownType, "unable to decode type %d", t)
+	}
+}
+
+// readDynamicStruct reads structure t. pointer is its reference id, when structure is pointed to
+func (c *decode_context) readDynamicStruct(buffer *decode_buffer, t uint16, pointer uint16) (interface{}, error) {
+
+	tData, ok := c.definition(t)
+	if !ok {
+		return nil, errorf(ErrUnknownType, "no definition for structure %d", t)
+	}
+
+	err := c.allocate(dynamicStructType, int(tData.FieldCount)*dynamicMapEntrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{}, tData.FieldCount)
+
+	if pointer != 0 {
+		c.pointers[pointer] = reflect.ValueOf(result)
+	}
+
+	for i := 0; i < int(tData.FieldCount); i++ {
+
+		f := &tData.Fields[i]
+
+		value, err := c.readDynamicField(buffer, f.Type)
+		if err != nil {
+			return nil, withPathElement(err, f.Name)
+		}
+
+		result[f.Name] = value
+	}
+
+	return result, nil
+}
+
+func (c *decode_context) readDynamicArray(buffer *decode_buffer, elementType uint16) (interface{}, error) {
+
+	ref, err := c.readDynamicReference(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	typeSize, err := c.typeSize(elementType)
+	if err != nil {
+		return nil, err
+	}
+
+	dataLen := len(ref.allocator.data)
+
+	var items int
+	if typeSize > 0 {
+		if dataLen%typeSize != 0 {
+			return nil, errorf(ErrMalformed, "array data length %d is not a multiple of element size %d", dataLen, typeSize)
+		}
+		items = dataLen / typeSize
+	}
+
+	// byte slices are kept as they are
+	if reflect.Kind(elementType) == reflect.Uint8 {
+		err = c.checkSliceLength(items)
+		if err == nil {
+			err = c.allocate(bytesType, items)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return append([]byte(nil), ref.allocator.data...), nil
+	}
+
+	err = c.checkSliceLength(items)
+	if err == nil {
+		err = c.allocate(dynamicSliceType, items*int(dynamicSliceType.Elem().Size()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]interface{}, items)
+
+	for i := 0; i < items; i++ {
+		result[i], err = c.readDynamicField(&ref, elementType)
+		if err != nil {
+			return nil, withPathElement(err, strconv.Itoa(i))
+		}
+	}
+
+	return result, nil
+}
+
+func (c *decode_context) readDynamicMap(buffer *decode_buffer, elType uint16, keyType uint16) (interface{}, error) {
+
+	// decoded structures and slices could not be map keys
+	if isArrayType(keyType) || keyType > internalTypesCount || reflect.Kind(keyType) == reflect.Map {
+		return nil, errorf(ErrTypeMismatch, "map key of type %d could not be decoded dynamically", keyType)
+	}
+
+	elemSize, err := c.typeSize(elType)
+	if err != nil {
+		return nil, err
+	}
+
+	keySize, err := c.typeSize(keyType)
+	if err != nil {
+		return nil, err
+	}
+	elemSize += keySize
+
+	dataLen := len(buffer.allocator.data)
+
+	if elemSize == 0 || dataLen%elemSize != 0 {
+		return nil, errorf(ErrMalformed, "map data length %d doesn't match entry size %d", dataLen, elemSize)
+	}
+
+	elems := dataLen / elemSize
+
+	err = c.checkSliceLength(elems)
+	if err == nil {
+		err = c.allocate(dynamicMapType, elems*dynamicMapEntrySize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stringKeys := reflect.Kind(keyType) == reflect.String
+
+	var byString map[string]interface{}
+	var byKey map[interface{}]interface{}
+
+	if stringKeys {
+		byString = make(map[string]interface{}, elems)
+	} else {
+		byKey = make(map[interface{}]interface{}, elems)
+	}
+
+	for i := 0; i < elems; i++ {
+
+		key, err := c.readDynamicField(buffer, keyType)
+		if err != nil {
+			return nil, withPathElement(err, "#"+strconv.Itoa(i))
+		}
+
+		value, err := c.readDynamicField(buffer, elType)
+		if err != nil {
+			return nil, withPathElement(err, toPathElement(key))
+		}
+
+		if stringKeys {
+			byString[key.(string)] = value
+		} else {
+			// interface keys may hold values which are not comparable
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				return nil, errorf(ErrTypeMismatch, "map key of type %T could not be decoded dynamically", key)
+			}
+			byKey[key] = value
+		}
+	}
+
+	if stringKeys {
+		return byString, nil
+	}
+
+	return byKey, nil
+}
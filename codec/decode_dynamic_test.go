@@ -0,0 +1,114 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeDynamic(t *testing.T) {
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(newTestStruct(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reader knows nothing about the types
+	reader := newTestCodec(t, binary.BigEndian)
+
+	ctx := reader.AcquireDecoder()
+	defer ctx.Release()
+
+	decoded, err := ctx.DecodeDynamic(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	product := map[string]interface{}{
+		"Name":  "json binary self describing proto",
+		"Price": 10.95,
+	}
+	nested := map[string]interface{}{
+		"Nint":    int64(99),
+		"Nstring": int64(38),
+		"N3":      int64(33),
+		"N5":      int64(55),
+		"Floa":    28973892.3833,
+		"Fl2":     99.98765432,
+		"Product": product,
+	}
+	expected := map[string]interface{}{
+		"Id":           int64(49),
+		"Value":        float64(float32(32720.2383)),
+		"NestedStruct": []interface{}{nested, nested},
+		"MapVal":       map[string]interface{}{"Int": int64(5), "Name": "serhii"},
+		"StrVal":       "holaAmigo grande!",
+	}
+
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", expected, decoded)
+	}
+}
+
+func TestDecodeDynamicMixed(t *testing.T) {
+
+	original := mixedStruct{
+		I32:     -7,
+		Strings: []string{"a", "b"},
+		Attrs:   map[string]interface{}{"k": "v", "nil": nil},
+		Counts:  map[string]int{"one": 1},
+		Any:     ProductVal{"p", 1.5},
+	}
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestCodec(t, binary.LittleEndian).AcquireDecoder()
+	defer ctx.Release()
+
+	decoded, err := ctx.DecodeDynamic(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := decoded.(map[string]interface{})
+
+	if fields["I32"] != int64(-7) {
+		t.Fatalf("unexpected I32: %v", fields["I32"])
+	}
+	if !reflect.DeepEqual(fields["Strings"], []interface{}{"a", "b"}) {
+		t.Fatalf("unexpected Strings: %v", fields["Strings"])
+	}
+	if !reflect.DeepEqual(fields["Attrs"], map[string]interface{}{"k": "v", "nil": nil}) {
+		t.Fatalf("unexpected Attrs: %v", fields["Attrs"])
+	}
+	if !reflect.DeepEqual(fields["Counts"], map[string]interface{}{"one": int64(1)}) {
+		t.Fatalf("unexpected Counts: %v", fields["Counts"])
+	}
+	if !reflect.DeepEqual(fields["Any"], map[string]interface{}{"Name": "p", "Price": 1.5}) {
+		t.Fatalf("unexpected Any: %v", fields["Any"])
+	}
+}
+
+func TestDecodeDynamicTruncated(t *testing.T) {
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(newTestStruct(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestCodec(t, binary.LittleEndian).AcquireDecoder()
+	defer ctx.Release()
+
+	for cut := 0; cut < len(encoded); cut++ {
+		_, err := ctx.DecodeDynamic(encoded[:cut])
+
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("cut at %d: expected DecodeError, got %v", cut, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package codec
+
+import "reflect"
+
+func limitError(what string, value int, limit int) error {
+	return errorf(ErrLimitExceeded, "%s %d, limit %d", what, value, limit)
+}
+
+func (ctx *decode_context) checkTypes(n int) error {
+	if ctx.options.MaxTypes > 0 && n > ctx.options.MaxTypes {
+		return limitError("types", n, ctx.options.MaxTypes)
+	}
+	return nil
+}
+
+// checkDefinedTypes checks that a context could keep one more definition with id
+func (ctx *decode_context) checkDefinedTypes(id uint16) error {
+
+	if _, replaced := ctx.overrides[id]; replaced || ctx.options.MaxDefinedTypes <= 0 {
+		return nil
+	}
+
+	if n := len(ctx.overrides) + 1; n > ctx.options.MaxDefinedTypes {
+		return limitError("defined types", n, ctx.options.MaxDefinedTypes)
+	}
+	return nil
+}
+
+func (ctx *decode_context) checkFields(n int) error {
+	if ctx.options.MaxFields > 0 && n > ctx.options.MaxFields {
+		return limitError("fields", n, ctx.options.MaxFields)
+	}
+	return nil
+}
+
+func (ctx *decode_context) checkSliceLength(n int) error {
+	if ctx.options.MaxSliceLength > 0 && n > ctx.options.MaxSliceLength {
+		return limitError("elements", n, ctx.options.MaxSliceLength)
+	}
+	return nil
+}
+
+func (ctx *decode_context) checkMessageSize(n int) error {
+	if ctx.options.MaxMessageSize > 0 && n > ctx.options.MaxMessageSize {
+		return limitError("message size", n, ctx.options.MaxMessageSize)
+	}
+	return nil
+}
+
+// allocate accounts n bytes about to be allocated for a value of type t
+func (ctx *decode_context) allocate(t reflect.Type, n int) error {
+
+	if ctx.options.Observer != nil {
+		ctx.options.Observer.Allocated(t, n)
+	}
+
+	ctx.allocated += n
+	if ctx.options.MaxAlloc > 0 && ctx.allocated > ctx.options.MaxAlloc {
+		return limitError("allocated bytes", ctx.allocated, ctx.options.MaxAlloc)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// expectLimit checks that err is a *DecodeError caused by a limit at path
+func expectLimit(t *testing.T, err error, path string) {
+
+	t.Helper()
+
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got %v", err)
+	}
+
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) {
+		t.Fatalf("expected *DecodeError, got %T", err)
+	}
+
+	if decErr.FieldPath != path {
+		t.Fatalf("limit exceeded at %q, expected %q", decErr.FieldPath, path)
+	}
+}
+
+// decodeLimited decodes a full message of newTestStruct(5) with options o
+func decodeLimited(t *testing.T, o DecodeOptions) error {
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(newTestStruct(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same message is in limits without options
+	ctx := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+
+	var out TestStruct
+	err = ctx.Decode(&out, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx = NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+	ctx.SetOptions(o)
+
+	return ctx.Decode(&out, encoded)
+}
+
+func TestMaxDepth(t *testing.T) {
+	// root, its field and an element of the field
+	expectLimit(t, decodeLimited(t, DecodeOptions{MaxDepth: 2}), "NestedStruct.0")
+}
+
+func TestMaxSliceLength(t *testing.T) {
+	expectLimit(t, decodeLimited(t, DecodeOptions{MaxSliceLength: 4}), "NestedStruct")
+}
+
+func TestMaxAlloc(t *testing.T) {
+	// 5 nested structures of 72 bytes and the first product name fit
+	expectLimit(t, decodeLimited(t, DecodeOptions{MaxAlloc: 400}), "NestedStruct.1.Product.Name")
+}
+
+func TestMaxTypes(t *testing.T) {
+	// definitions are checked before any data
+	expectLimit(t, decodeLimited(t, DecodeOptions{MaxTypes: 2}), "")
+}
+
+func TestMaxFields(t *testing.T) {
+	expectLimit(t, decodeLimited(t, DecodeOptions{MaxFields: 5}), "")
+}
+
+func TestMaxDefinedTypes(t *testing.T) {
+
+	ctx := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+	ctx.SetOptions(DecodeOptions{MaxDefinedTypes: 30})
+
+	// every message replaces definitions of the previous one
+	for i := 0; i < 5; i++ {
+		encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(newWideValue(fmt.Sprintf("V%d", i), 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ctx.DecodeDynamic(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ids of structures nested in a wider one are new to the context
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(newWideValue("V", 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctx.DecodeDynamic(encoded)
+	expectLimit(t, err, "")
+
+	// reset context forgets definitions
+	ctx.Reset()
+
+	encoded, err = newTestCodec(t, binary.LittleEndian).Marshal(newWideValue("V", 25))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctx.DecodeDynamic(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	var stream bytes.Buffer
+
+	encoder := NewStreamEncoder(c, &stream)
+	for _, n := range []int{1, 10} {
+		err := encoder.Encode(newTestStruct(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	firstSize := int(frameOrder.Uint32(stream.Bytes()))
+
+	decoder := NewStreamDecoder(c, &stream)
+	decoder.ctx.SetOptions(DecodeOptions{MaxMessageSize: firstSize})
+
+	var out TestStruct
+
+	err := decoder.Next(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = decoder.Next(&out)
+	expectLimit(t, err, "")
+}
+
+// selfReferencingInterface returns a message without a header, root interface of which
+// holds an interface stored in reference 1, which holds itself
+func selfReferencingInterface() []byte {
+
+	iface := byte(reflect.Interface)
+
+	return []byte{
+		0,        // no definitions
+		iface, 0, // root type
+		iface, 0, 1, 0, // root data, interface in reference 1
+		4, 0, iface, 0, 1, 0, // reference 1, the same interface
+	}
+}
+
+func TestMaxDepthAlwaysApplied(t *testing.T) {
+
+	message := selfReferencingInterface()
+
+	for _, o := range []DecodeOptions{{}, {MaxDepth: 1 << 30}} {
+
+		ctx := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+		ctx.SetOptions(o)
+
+		var out interface{}
+		err := ctx.Decode(&out, message)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("MaxDepth %d: expected ErrLimitExceeded, got %v", o.MaxDepth, err)
+		}
+
+		_, err = ctx.DecodeDynamic(message)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("MaxDepth %d: expected ErrLimitExceeded from DecodeDynamic, got %v", o.MaxDepth, err)
+		}
+	}
+}
+
+type listNode struct {
+	Value int
+	Next  *listNode
+}
+
+// newTestList returns a linked list of n nodes with values from 1
+func newTestList(n int) *listNode {
+
+	var head *listNode
+	for i := n; i > 0; i-- {
+		head = &listNode{Value: i, Next: head}
+	}
+
+	return head
+}
+
+// checkTestList checks that list has n nodes with values from 1
+func checkTestList(t *testing.T, list *listNode, n int) {
+
+	t.Helper()
+
+	i := 0
+	for node := list; node != nil; node = node.Next {
+		i++
+		if node.Value != i {
+			t.Fatalf("node %d has value %d", i, node.Value)
+		}
+	}
+
+	if i != n {
+		t.Fatalf("decoded %d nodes, expected %d", i, n)
+	}
+}
+
+func TestDeepPointerChain(t *testing.T) {
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(newTestList(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// default options read back what the codec writes
+	var out listNode
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestList(t, &out, 1000)
+}
+
+func TestStreamFrameAllocation(t *testing.T) {
+
+	// length prefix of a 2GB frame without its payload
+	header := []byte{0xff, 0xff, 0xff, 0x7f}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	decoder := NewStreamDecoder(newTestCodec(t, binary.LittleEndian), bytes.NewReader(header))
+
+	err := decoder.Next(&TestStruct{})
+	if err != ErrTruncatedFrame {
+		t.Fatalf("expected ErrTruncatedFrame, got %v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("%d bytes allocated for an empty frame", allocated)
+	}
+}
@@ -0,0 +1,107 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type attachment struct {
+	Name  string
+	Data  []byte
+	Notes []string
+	Extra interface{}
+}
+
+type mailbox struct {
+	Attachments []attachment
+}
+
+func TestDeduplicateReferences(t *testing.T) {
+
+	blob := []byte("binary content of the attachment")
+
+	original := mailbox{[]attachment{
+		{Name: "first", Data: blob, Notes: []string{"first", "same", "same"}, Extra: "same"},
+		{Name: "second", Data: append([]byte(nil), blob...), Notes: []string{"same"}, Extra: "first"},
+		{Name: "binary content of the attachment", Data: []byte{}, Notes: []string{}},
+	}}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		ctx := NewEncodeContext(newTestCodec(t, order))
+
+		plain, err := ctx.EncodeFullCopy(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.SetOptions(EncodeOptions{Header: true, Deduplicate: true})
+
+		deduplicated, err := ctx.EncodeFullCopy(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(deduplicated) >= len(plain) {
+			t.Fatalf("deduplicated message is %d bytes, plain one is %d", len(deduplicated), len(plain))
+		}
+
+		// decoders need no option to read it
+		var out mailbox
+		err = newTestCodec(t, order).Unmarshal(deduplicated, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(original, out) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", original, out)
+		}
+
+		// decoded byte slices don't share memory
+		out.Attachments[0].Data[0] = 'B'
+		if bytes.Equal(out.Attachments[0].Data, out.Attachments[1].Data) {
+			t.Fatal("byte slices decoded from the same reference share memory")
+		}
+	}
+}
+
+func TestDeduplicateRepeatedRecords(t *testing.T) {
+
+	value := newTestStruct(10)
+
+	c := newTestCodec(t, binary.LittleEndian)
+	ctx := NewEncodeContext(c)
+
+	plain, err := ctx.EncodeFullCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.SetOptions(EncodeOptions{Header: true, Deduplicate: true})
+
+	// shared ids are forgotten between messages
+	for i := 0; i < 2; i++ {
+		deduplicated, err := ctx.EncodeFullCopy(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// product name and its length are written once instead of ten times
+		saved := 9 * (2 + len(value.NestedStruct[0].Product.Name))
+		if len(plain)-len(deduplicated) != saved {
+			t.Fatalf("deduplication saved %d bytes, want %d", len(plain)-len(deduplicated), saved)
+		}
+
+		var out TestStruct
+		err = c.Unmarshal(deduplicated, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(value, out) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", value, out)
+		}
+	}
+}
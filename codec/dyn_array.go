@@ -23,11 +23,22 @@ func (this *DynamicArray) Clear() {
 
 func (this *DynamicArray) Push(val uint16) {
 	if !this.Contains(val) {
+		if this.pos == len(this.data) {
+			this.data = append(this.data, 0)
+			this.size = len(this.data)
+		}
 		this.data[this.pos] = int(val)
 		this.pos++
 	}
 }
 
+// Pop removes the last value
+func (this *DynamicArray) Pop() {
+	if this.pos > 0 {
+		this.pos--
+	}
+}
+
 func (this *DynamicArray) Contains(val uint16) bool {
 
 	if this.pos == 0 {
@@ -43,6 +54,18 @@ func (this *DynamicArray) Contains(val uint16) bool {
 	return false
 }
 
+// IndexOf returns position of val or -1
+func (this *DynamicArray) IndexOf(val uint16) int {
+
+	for i := 0; i < this.pos; i++ {
+		if this.data[i] == int(val) {
+			return i
+		}
+	}
+
+	return -1
+}
+
 func (this *DynamicArray) Length() int {
 	return this.pos
 }
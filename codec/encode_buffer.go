@@ -35,6 +35,7 @@ func NewEncodeBuffer(size int, order binary.ByteOrder) encode_buffer {
 }
 
 func (this encode_buffer) Branch(areaSize int) encode_buffer {
+	this.tryGrow(areaSize)
 	copy := this.BranchParalel()
 	this.pos += areaSize
 	return copy
@@ -65,13 +66,15 @@ func (this encode_buffer) ReadByte() (n byte, err error) {
 func (this encode_buffer) grow(atLeast int) {
 
 	newSize := this.size * 2
-	if atLeast > newSize {
-		newSize += atLeast
+	if this.pos+atLeast > newSize {
+		newSize = this.pos + atLeast + this.size
 	}
 
 	newBuf := make([]byte, newSize)
 
-	copy(newBuf, this.data[:this.pos])
+	// branches share the data, so everything is kept,
+	// not only the part before this branch position
+	copy(newBuf, this.data)
 	this.data = newBuf
 	this.size = newSize
 }
@@ -97,6 +100,16 @@ func (this encode_buffer) Write(p []byte) (n int, err error) {
 	return
 }
 
+func (this encode_buffer) WriteString(s string) (n int, err error) {
+
+	this.tryGrow(len(s))
+
+	n = copy(this.data[this.pos:], s)
+	this.pos += n
+
+	return
+}
+
 func (this encode_buffer) Next(i int) {
 	this.tryGrow(i)
 	this.pos += i
@@ -124,10 +137,12 @@ func (this encode_buffer) PutUint16(v uint16) {
 	this.pos += 2
 }
 
-func (this encode_buffer) WriteByte(u uint8) {
+func (this encode_buffer) WriteByte(u byte) error {
 	this.tryGrow(1)
 	this.data[this.pos] = u
 	this.pos++
+
+	return nil
 }
 
 func (this encode_buffer) PutFloat64(f float64) {
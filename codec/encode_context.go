@@ -1,7 +1,6 @@
 package codec
 
 import (
-	"github.com/dot5enko/transbin/utils"
 	"reflect"
 )
 
@@ -9,10 +8,25 @@ type encode_context struct {
 	global    *codec
 	usedTypes *DynamicArray
 
+	// structures being listed by useType
+	listing *DynamicArray
+
 	ref *references_writer
 
 	result_buffer encode_buffer
 	data_buffer   encode_buffer
+
+	options EncodeOptions
+
+	// structure definitions already written to a stream, nil if not streaming
+	sentTypes map[uint16]bool
+
+	// reference ids of pointers written to the current message, when tracking them
+	pointers map[pointerKey]uint16
+
+	// nesting of structures and maps being written, deep ones are checked for cycles
+	depth    int
+	visiting map[pointerKey]bool
 }
 
 func NewEncodeContext(global *codec) *encode_context {
@@ -20,6 +34,7 @@ func NewEncodeContext(global *codec) *encode_context {
 	result := &encode_context{}
 
 	result.usedTypes = NewDArray(10)
+	result.listing = NewDArray(4)
 
 	result.data_buffer = global.get_free_ebuffer(1024)
 	result.result_buffer = global.get_free_ebuffer(1024)
@@ -27,51 +42,132 @@ func NewEncodeContext(global *codec) *encode_context {
 	result.ref, _ = NewReferencesWriter(16, global.order)
 
 	result.global = global
+	result.options = global.encodeOptions
 
 	return result
 }
 
 func (c encode_context) useType(t uint16) {
+
+	// only structures have definitions in the header
+	if t <= internalTypesCount || c.usedTypes.Contains(t) || c.listing.Contains(t) {
+		return
+	}
+
+	// nested structures are listed before the ones using them,
+	// so decoder knows their sizes, even if there were no values of them.
+	// structures referring to themselves through slices are listed once
+	if def, ok := c.global.types().byId(t); ok {
+		c.listing.Push(t)
+		for _, f := range def.Fields {
+			c.useType(getArrayElementType(f.Type))
+		}
+		c.listing.Pop()
+	}
+
 	c.usedTypes.Push(t)
 }
 
+// wireType returns id of type t in the message. canonical messages number
+// structures in order of their use, instead of the codec's registration order
+func (c *encode_context) wireType(t uint16) uint16 {
+
+	elem := getArrayElementType(t)
+	if !c.options.Canonical || elem <= internalTypesCount {
+		return t
+	}
+
+	c.useType(elem)
+
+	id := firstStructId + uint16(c.usedTypes.IndexOf(elem))
+	if isArrayType(t) {
+		return setArrayTypeFlag(id)
+	}
+
+	return id
+}
+
 func (c encode_context) Reset() {
 	c.usedTypes.Clear()
 	c.data_buffer.Reset()
 	c.ref.Reset()
 
+	for key := range c.pointers {
+		delete(c.pointers, key)
+	}
+	for key := range c.visiting {
+		delete(c.visiting, key)
+	}
+
 	c.result_buffer.Reset()
 }
 
+// EncodeFull encodes obj along with definitions of all structures it uses.
+// returned slice is backed by the context's internal buffer: it stays valid only
+// until the next Encode*, Reset or Release call on this context, and must not be
+// modified or retained beyond that. use EncodeFullCopy or AppendEncodeFull to keep the result
 func (c *encode_context) EncodeFull(obj interface{}) ([]byte, error) {
 	return c.encodeInternal(obj, true)
 }
+
+// Encode encodes obj without structure definitions, decoder should already know them.
+// canonical messages always carry definitions, as their ids are local to a message.
+// same lifetime rules as for EncodeFull apply to the returned slice
 func (c *encode_context) Encode(obj interface{}) ([]byte, error) {
 	return c.encodeInternal(obj, false)
 }
+
+// AppendEncodeFull appends full encoding of obj to dst and returns the extended slice.
+// the result never aliases context buffers, so it can be retained or sent elsewhere
+func (c *encode_context) AppendEncodeFull(dst []byte, obj interface{}) ([]byte, error) {
+	return c.appendInternal(dst, obj, true)
+}
+
+// AppendEncode appends data only encoding of obj to dst and returns the extended slice
+func (c *encode_context) AppendEncode(dst []byte, obj interface{}) ([]byte, error) {
+	return c.appendInternal(dst, obj, false)
+}
+
+// EncodeFullCopy works like EncodeFull, but returns a newly allocated slice owned by the caller
+func (c *encode_context) EncodeFullCopy(obj interface{}) ([]byte, error) {
+	return c.appendInternal(nil, obj, true)
+}
+
+// EncodeCopy works like Encode, but returns a newly allocated slice owned by the caller
+func (c *encode_context) EncodeCopy(obj interface{}) ([]byte, error) {
+	return c.appendInternal(nil, obj, false)
+}
+
 func (c *encode_context) encodeElementToBuffer(buffer encode_buffer, o reflect.Value) (uint16, error) {
 
 	var writtenType uint16 = 0
 
 	t := o.Type()
 
+	// tracked pointers are written as references, others as values they point to
+	if t.Kind() == reflect.Ptr && c.options.TrackPointers {
+		return uint16(reflect.Ptr), c.writePointerFieldData(buffer, o)
+	}
+
 	switch t.Kind() {
 
 	case reflect.Struct:
 
 		// general case when serializing object is a struct
-		generalStruct, err := c.registerStructure(t)
+		plan, err := c.global.encodePlan(t)
 		if err != nil {
 			return 0, err
 		}
 
+		c.useType(plan.def.Id)
+
 		// data
-		err = c.writeComplexType(buffer, generalStruct.Id, o)
+		err = c.writePlan(buffer, plan, o)
 		if err != nil {
 			return 0, err
 		}
 
-		writtenType = generalStruct.Id
+		writtenType = plan.def.Id
 
 	case reflect.Map:
 
@@ -84,13 +180,13 @@ func (c *encode_context) encodeElementToBuffer(buffer encode_buffer, o reflect.V
 
 		writtenType = uint16(reflect.Map)
 	case reflect.Array:
-		panic("don't know how to write arary")
+		return 0, &UnsupportedTypeError{t}
 	default:
 		// its a case for map value
 		var err error
 
 		fakeField := codecStructField{}
-		fakeField.Type, err = c.global.getType(o.Type())
+		fakeField.Type, err = c.valueType(o.Type())
 		if err != nil {
 			return 0, err
 		}
@@ -107,30 +203,67 @@ func (c *encode_context) encodeElementToBuffer(buffer encode_buffer, o reflect.V
 	return writtenType, nil
 }
 
-func (c *encode_context) encodeInternal(obj interface{}, full bool) ([]byte, error) {
+// encodeParts encodes obj into data and references buffers
+// and writes structure header into result buffer
+func (c *encode_context) encodeParts(obj interface{}, full bool) error {
 
 	c.Reset()
+	c.depth = 0
+
+	// canonical ids are local to a message, so they are useless without definitions
+	if c.options.Canonical {
+		full = true
+	}
 
 	o := reflect.Indirect(reflect.ValueOf(obj))
+	if !o.IsValid() {
+		return errorf(ErrNilPointer, "nothing to encode in %T", obj)
+	}
 
 	// allocate 2 bytes for element type
 	start := c.data_buffer.Branch(2)
 
-	typeId, err := c.encodeElementToBuffer(c.data_buffer, o)
+	var typeId uint16
+	var err error
+
+	// root could be pointed to from within the value
+	if root := reflect.ValueOf(obj); c.options.TrackPointers && root.Kind() == reflect.Ptr {
+		typeId = uint16(reflect.Ptr)
+		err = c.writePointerFieldData(c.data_buffer, root)
+	} else {
+		typeId, err = c.encodeElementToBuffer(c.data_buffer, o)
+	}
 
-	start.PutUint16(typeId)
+	start.PutUint16(c.wireType(typeId))
 
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if c.options.Header {
+		c.writeMessageHeader(c.result_buffer, full)
 	}
 
 	// write structure
 	if full {
-		c.writeStructureData(c.result_buffer)
+		err = c.writeStructureData(c.result_buffer)
+		if err != nil {
+			return err
+		}
 	} else {
 		c.result_buffer.WriteByte(0)
 	}
 
+	return nil
+}
+
+func (c *encode_context) encodeInternal(obj interface{}, full bool) ([]byte, error) {
+
+	err := c.encodeParts(obj, full)
+	if err != nil {
+		return nil, err
+	}
+
 	// actual data
 	c.result_buffer.Write(c.data_buffer.Bytes())
 
@@ -143,6 +276,32 @@ func (c *encode_context) encodeInternal(obj interface{}, full bool) ([]byte, err
 	return c.result_buffer.Bytes(), nil
 }
 
+func (c *encode_context) appendInternal(dst []byte, obj interface{}, full bool) ([]byte, error) {
+
+	err := c.encodeParts(obj, full)
+	if err != nil {
+		return dst, err
+	}
+
+	header := c.result_buffer.Bytes()
+	data := c.data_buffer.Bytes()
+	refsData := c.ref.buff.Bytes()
+
+	// grow dst at most once
+	need := len(header) + len(data) + len(refsData)
+	if cap(dst)-len(dst) < need {
+		grown := make([]byte, len(dst), len(dst)+need)
+		copy(grown, dst)
+		dst = grown
+	}
+
+	dst = append(dst, header...)
+	dst = append(dst, data...)
+	dst = append(dst, refsData...)
+
+	return dst, nil
+}
+
 func (c encode_context) writeSimpleFieldData(buffer *encode_buffer, v reflect.Value) error {
 
 
@@ -157,7 +316,7 @@ func (c encode_context) writeSimpleFieldData(buffer *encode_buffer, v reflect.Va
 	case reflect.Float64:
 			buffer.PutFloat64(v.Float())
 	default:
-		return utils.Error("no handler for writing simple type %s", v.Kind().String())
+		return &UnsupportedTypeError{v.Type()}
 	}
 
 	return nil
@@ -167,17 +326,21 @@ func (c *encode_context) writeComplexType(buffer encode_buffer, t uint16, v refl
 
 	c.useType(t)
 
-	cf := c.global.types[t].Fields
-
-	for i := 0; i < int(c.global.types[t].FieldCount); i++ {
-		err = c.writeFieldData(buffer, cf[i], reflect.Indirect(v).Field(i))
-		if err != nil {
-			return
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		def, _ := c.global.types().byId(t)
+		if def == nil {
+			return errorf(ErrUnknownType, "no definition for type %d", t)
 		}
+		return errorf(ErrNilPointer, "structure %s", def.Name)
 	}
 
-	return
+	plan, err := c.global.encodePlan(v.Type())
+	if err != nil {
+		return err
+	}
 
+	return c.writePlan(buffer, plan, v)
 }
 
 func (c *encode_context) writeFieldData(buffer encode_buffer, field codecStructField, v reflect.Value) (err error) {
@@ -201,7 +364,7 @@ func (c *encode_context) writeFieldData(buffer encode_buffer, field codecStructF
 					return
 				}
 			default:
-				c.writeSimpleFieldData(&buffer, v)
+				err = c.writeSimpleFieldData(&buffer, v)
 			}
 		}
 	}
@@ -212,11 +375,23 @@ func (c *encode_context) writeFieldData(buffer encode_buffer, field codecStructF
 
 func (c *encode_context) writeReferenceFieldData(buffer encode_buffer, t uint16, v reflect.Value) error {
 
+	// repeated strings and byte slices point to the first occurrence
+	if c.options.Deduplicate {
+		if id, ok := c.sharedReference(t, v); ok {
+			buffer.PutUint16(id)
+			return nil
+		}
+	}
+
 	id, err := c.putReference(buffer, t, v)
 	if err != nil {
 		return err
 	}
 
+	if c.options.Deduplicate {
+		c.share(t, v, id)
+	}
+
 	buffer.PutUint16(id)
 
 	return nil
@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dot5enko/transbin/utils"
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// errors returned by codec could be matched with errors.Is against these values.
+// errors caused by encoded data are wrapped into *DecodeError,
+// the ones caused by Go types codec can't handle into *UnsupportedTypeError
+var (
+	// read past the end of encoded data
+	ErrUnexpectedEOF = errors.New("unexpected end of transbin data")
+	// message header describes data codec can't read
+	ErrIncompatibleFormat = errors.New("incompatible transbin format")
+	// message needs more resources than DecodeOptions allow
+	ErrLimitExceeded = errors.New("transbin decode limit exceeded")
+	// stream ended in the middle of a frame
+	ErrTruncatedFrame = errors.New("truncated frame in transbin stream")
+	// data refers to a structure without a definition
+	ErrUnknownType = errors.New("unknown transbin type")
+	// encoded type can't be stored into destination value
+	ErrTypeMismatch = errors.New("transbin type mismatch")
+	// reference id is out of references table
+	ErrInvalidReference = errors.New("invalid transbin reference")
+	// lengths or sizes in data are inconsistent
+	ErrMalformed = errors.New("malformed transbin data")
+	// Go type could not be encoded or decoded
+	ErrUnsupportedType = errors.New("unsupported type")
+	// Decode got something other than a non nil pointer
+	ErrInvalidTarget = errors.New("transbin decode target should be a non nil pointer")
+	// too many references or too long referenced data in a message
+	ErrReferenceOverflow = errors.New("transbin references overflow")
+	// nil pointer to a structure could not be encoded
+	ErrNilPointer = errors.New("transbin nil pointer")
+	// value contains itself, which needs EncodeOptions.TrackPointers to be encoded
+	ErrCyclicValue = errors.New("transbin cyclic value")
+	// path given to Get doesn't match the message
+	ErrPathNotFound = errors.New("transbin path not found")
+)
+
+// UnexpectedEOFError reports a read which needs more bytes than left in data
+type UnexpectedEOFError struct {
+	// offset of the read from the start of the message
+	Offset int
+	Need   int
+	Have   int
+}
+
+func (e *UnexpectedEOFError) Error() string {
+	return fmt.Sprintf("%s: at offset %d, need %d bytes, have %d", ErrUnexpectedEOF, e.Offset, e.Need, e.Have)
+}
+
+func (e *UnexpectedEOFError) Is(target error) bool {
+	return target == ErrUnexpectedEOF
+}
+
+// DecodeError describes where decoding of a message failed
+type DecodeError struct {
+	// offset of the failed value from the start of the message
+	Offset int
+	// wire type of the failed value
+	TypeID uint16
+	// dot separated struct field names and slice indexes, empty for the root value
+	FieldPath string
+	Err       error
+
+	// stack of the failed read, set only when utils.CaptureStack is enabled
+	Stack []byte
+}
+
+func (e *DecodeError) Error() string {
+
+	path := e.FieldPath
+	if path == "" {
+		path = "<root>"
+	}
+
+	return fmt.Sprintf("transbin: decode %s (type %d) at offset %d: %s", path, e.TypeID, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedTypeError is returned for Go types codec doesn't know how to handle
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("transbin: %s %s", ErrUnsupportedType, e.Type)
+}
+
+func (e *UnsupportedTypeError) Is(target error) bool {
+	return target == ErrUnsupportedType
+}
+
+func errorf(sentinel error, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{sentinel}, args...)...)
+}
+
+// decodeError wraps err into *DecodeError, unless it is one already
+func decodeError(err error, offset int, typeId uint16) error {
+
+	var decErr *DecodeError
+	if errors.As(err, &decErr) {
+		return err
+	}
+
+	result := &DecodeError{Offset: offset, TypeID: typeId, Err: err}
+	if utils.CaptureStack {
+		result.Stack = debug.Stack()
+	}
+
+	return result
+}
+
+// toPathElement formats map key as a field path element
+func toPathElement(key interface{}) string {
+	return fmt.Sprint(key)
+}
+
+// withPathElement prepends name to the field path of a *DecodeError
+func withPathElement(err error, name string) error {
+
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) {
+		return err
+	}
+
+	if decErr.FieldPath == "" {
+		decErr.FieldPath = name
+	} else {
+		decErr.FieldPath = strings.Join([]string{name, decErr.FieldPath}, ".")
+	}
+
+	return err
+}
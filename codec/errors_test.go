@@ -0,0 +1,350 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeErrorTruncated(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(newTestStruct(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(encoded); i++ {
+
+		var out TestStruct
+		err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded[:i], &out)
+
+		// cut between references leaves a valid table missing some of them
+		if !errors.Is(err, ErrUnexpectedEOF) && !errors.Is(err, ErrInvalidReference) {
+			t.Fatalf("length %d: expected unexpected EOF, got %v", i, err)
+		}
+
+		var decErr *DecodeError
+		if !errors.As(err, &decErr) {
+			t.Fatalf("length %d: expected *DecodeError, got %T", i, err)
+		}
+	}
+}
+
+func TestDecodeErrorFieldPath(t *testing.T) {
+
+	type nameAsInt struct {
+		Int  int
+		Name int
+	}
+
+	type mismatched struct {
+		Id           int
+		Value        float32
+		NestedStruct []NStruct
+		MapVal       nameAsInt
+		StrVal       string
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(newTestStruct(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out mismatched
+	err = c.Unmarshal(encoded, &out)
+
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) {
+		t.Fatalf("expected *DecodeError, got %T", err)
+	}
+
+	if decErr.FieldPath != "MapVal.Name" {
+		t.Fatalf("unexpected field path %q", decErr.FieldPath)
+	}
+
+	if decErr.TypeID != uint16(reflect.String) {
+		t.Fatalf("unexpected type id %d", decErr.TypeID)
+	}
+
+	if decErr.Offset <= 0 || decErr.Offset >= len(encoded) {
+		t.Fatalf("offset %d is out of message", decErr.Offset)
+	}
+}
+
+func TestUnsupportedTypeError(t *testing.T) {
+
+	type withChannel struct {
+		Events chan int
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	_, err := c.Marshal(withChannel{})
+
+	var typeErr *UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected *UnsupportedTypeError, got %v", err)
+	}
+
+	if typeErr.Type != reflect.TypeOf(make(chan int)) {
+		t.Fatalf("unexpected type %s", typeErr.Type)
+	}
+
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Fatal("error should match ErrUnsupportedType")
+	}
+}
+
+func TestDecodeInvalidTarget(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(ProductVal{"name", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nilTarget *ProductVal
+	for _, target := range []interface{}{ProductVal{}, nilTarget, nil} {
+		err = c.Unmarshal(encoded, target)
+		if !errors.Is(err, ErrInvalidTarget) {
+			t.Fatalf("%T: expected invalid target error, got %v", target, err)
+		}
+	}
+}
+
+func TestDecodeArrayElementError(t *testing.T) {
+
+	type priceAsString struct {
+		Name  string
+		Price string
+	}
+
+	type nested struct {
+		Nint    int
+		Nstring int
+		N3      int
+		N5      int
+		Floa    float64
+		Fl2     float64
+		Product priceAsString
+	}
+
+	type mismatched struct {
+		Id           int
+		Value        float32
+		NestedStruct []nested
+		MapVal       MapValStruct
+		StrVal       string
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(newTestStruct(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out mismatched
+	err = c.Unmarshal(encoded, &out)
+
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) || !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch *DecodeError, got %v", err)
+	}
+
+	if decErr.FieldPath != "NestedStruct.0.Product.Price" {
+		t.Fatalf("unexpected field path %q", decErr.FieldPath)
+	}
+}
+
+func TestDecodeInterfaceError(t *testing.T) {
+
+	type holder struct {
+		Any interface{}
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(holder{ProductVal{"name", 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// structures could not be decoded into interfaces
+	var out holder
+	err = c.Unmarshal(encoded, &out)
+
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) || !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch *DecodeError, got %v", err)
+	}
+
+	if decErr.FieldPath != "Any" {
+		t.Fatalf("unexpected field path %q", decErr.FieldPath)
+	}
+}
+
+func TestEncodeInterfaceNil(t *testing.T) {
+
+	type holder struct {
+		Any  interface{}
+		Name string
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(holder{nil, "after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := holder{Any: 5}
+	err = c.Unmarshal(encoded, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Any != nil || out.Name != "after" {
+		t.Fatalf("unexpected result %+v", out)
+	}
+}
+
+func TestEncodeSimpleFieldError(t *testing.T) {
+
+	type withComplex struct {
+		Name  string
+		Value complex64
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	_, err := c.Marshal(withComplex{"name", 1})
+
+	var typeErr *UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected *UnsupportedTypeError, got %v", err)
+	}
+}
+
+func TestEncodeMapErrors(t *testing.T) {
+
+	type withChannel struct {
+		Events chan int
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	values := []interface{}{
+		// element type error was hidden by successful key type lookup
+		map[string]withChannel{"a": {}},
+		map[withChannel]string{{}: "a"},
+		// errors of entries were lost
+		map[string]interface{}{"a": make(chan int)},
+		map[string]interface{}{"a": complex(1, 2)},
+	}
+
+	for _, v := range values {
+		_, err := c.Marshal(struct{ Map interface{} }{v})
+		if !errors.Is(err, ErrUnsupportedType) {
+			t.Fatalf("%T: expected unsupported type, got %v", v, err)
+		}
+	}
+}
+
+func TestEncodeNilPointer(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	var nilStruct *TestStruct
+	_, err := c.Marshal(nilStruct)
+	if !errors.Is(err, ErrNilPointer) {
+		t.Fatalf("expected nil pointer error, got %v", err)
+	}
+
+	_, err = c.Marshal(struct{ Items []*ProductVal }{[]*ProductVal{nil}})
+	if !errors.Is(err, ErrNilPointer) {
+		t.Fatalf("expected nil pointer error, got %v", err)
+	}
+}
+
+// regression: length of large slices overflowed silently, producing unreadable messages
+func TestEncodeReferenceOverflow(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	_, err := c.Marshal(mixedStruct{Floats: make([]float64, maxReferenceLength/8+1)})
+	if !errors.Is(err, ErrReferenceOverflow) {
+		t.Fatalf("expected ErrReferenceOverflow, got %v", err)
+	}
+
+	_, err = c.Marshal(mixedStruct{Floats: make([]float64, maxReferenceLength/8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// regression: messages using over 255 structures panicked
+func TestEncodeTooManyStructures(t *testing.T) {
+
+	fields := []reflect.StructField{
+		{Name: "A", Type: reflect.TypeOf(newWideValue("A", 150))},
+		{Name: "B", Type: reflect.TypeOf(newWideValue("B", 150))},
+	}
+	value := reflect.New(reflect.StructOf(fields)).Elem().Interface()
+
+	_, err := newTestCodec(t, binary.LittleEndian).Marshal(value)
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+
+	// each half fits
+	_, err = newTestCodec(t, binary.LittleEndian).Marshal(newWideValue("A", 150))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// regression: field count and names of definitions were silently truncated to a byte
+func TestEncodeDefinitionLimits(t *testing.T) {
+
+	fields := make([]reflect.StructField, maxDefinitionLength+1)
+	for i := range fields {
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("F%d", i), Type: reflect.TypeOf(0)}
+	}
+
+	values := []interface{}{
+		reflect.New(reflect.StructOf(fields)).Elem().Interface(),
+		reflect.New(reflect.StructOf([]reflect.StructField{{Name: "L" + strings.Repeat("o", maxDefinitionLength), Type: reflect.TypeOf(0)}})).Elem().Interface(),
+	}
+
+	for _, value := range values {
+		c := newTestCodec(t, binary.LittleEndian)
+
+		_, err := c.Marshal(value)
+		if !errors.Is(err, ErrUnsupportedType) {
+			t.Fatalf("expected ErrUnsupportedType, got %v", err)
+		}
+
+		if n := len(c.types().types); n != 0 {
+			t.Fatalf("%d structures registered", n)
+		}
+	}
+
+	// the largest ones are encoded
+	_, err := newTestCodec(t, binary.LittleEndian).Marshal(reflect.New(reflect.StructOf(fields[:maxDefinitionLength])).Elem().Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,126 @@
+package codec
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// seedMessages are EncodeFull outputs of test structures
+func seedMessages(f *testing.F) [][]byte {
+
+	var result [][]byte
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, header := range []bool{true, false} {
+
+			c := newTestCodec(f, order)
+			c.SetEncodeOptions(EncodeOptions{Header: header})
+			ctx := NewEncodeContext(c)
+
+			for _, nested := range []int{0, 1, 3, 10} {
+				encoded, err := ctx.EncodeFullCopy(newTestStruct(nested))
+				if err != nil {
+					f.Fatal(err)
+				}
+				result = append(result, encoded)
+			}
+
+			for _, v := range []interface{}{ProductVal{"name", 1.5}, MapValStruct{7, "map"}, NStruct{}} {
+				encoded, err := ctx.EncodeFullCopy(v)
+				if err != nil {
+					f.Fatal(err)
+				}
+				result = append(result, encoded)
+			}
+		}
+	}
+
+	return result
+}
+
+func FuzzDecode(f *testing.F) {
+
+	for _, seed := range seedMessages(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		c := newTestCodec(t, binary.LittleEndian)
+		ctx := NewDecodeContext(c)
+
+		var out TestStruct
+		_ = ctx.Decode(&out, data)
+
+		// same context should stay usable after malformed input
+		var product ProductVal
+		_ = ctx.Decode(&product, data)
+	})
+}
+
+func FuzzTryDecodeStructure(f *testing.F) {
+
+	for _, seed := range seedMessages(f) {
+		if hasMessageHeader(seed) {
+			seed = seed[messageHeaderSize:]
+		}
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		c := newTestCodec(t, binary.LittleEndian)
+		ctx := NewDecodeContext(c)
+
+		ctx.buffer.Init(data)
+
+		headerSize, err := ctx.tryDecodeStructure()
+		if err == nil && headerSize > len(data) {
+			t.Fatalf("header size %d is beyond data length %d", headerSize, len(data))
+		}
+	})
+}
+
+func FuzzReferencesReaderInit(f *testing.F) {
+
+	refs, err := NewReferencesWriter(16, binary.LittleEndian)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add([]byte{})
+	for _, s := range []string{"", "a", "json binary self describing proto", "serhii"} {
+		refs.Put([]byte(s))
+		f.Add(append([]byte(nil), refs.buff.Bytes()...))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		reader := new_references_reader(binary.LittleEndian)
+
+		err := reader.Init(data, 0)
+		if err != nil {
+			return
+		}
+
+		total := 0
+		for id := uint64(1); id <= reader.refsCount; id++ {
+			ref, offset, err := reader.Get(id)
+			if err != nil {
+				t.Fatalf("reference %d of %d: %v", id, reader.refsCount, err)
+			}
+			if offset+len(ref) > len(data) {
+				t.Fatalf("reference %d is out of data", id)
+			}
+			total += 2 + len(ref)
+		}
+
+		if total != len(data) {
+			t.Fatalf("references cover %d bytes of %d", total, len(data))
+		}
+
+		if _, _, err := reader.Get(reader.refsCount + 1); err == nil {
+			t.Fatal("reference beyond count should not be found")
+		}
+	})
+}
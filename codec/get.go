@@ -0,0 +1,246 @@
+package codec
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Get decodes a single value at path, without decoding the rest of the message.
+// path elements are separated by dots: names of structure fields, indexes of arrays
+// and keys of maps, e.g. "NestedStruct.3.Product.Price". empty path selects the root.
+// pointers and interfaces on the way are followed to values they hold.
+// value is returned as by DecodeDynamic
+func (c *decode_context) Get(input []byte, path string) (interface{}, error) {
+
+	t, err := c.readMessage(input)
+	if err != nil {
+		return nil, decodeError(err, c.buffer.Offset(), 0)
+	}
+
+	buffer := *c.buffer
+
+	for start := 0; path != "" && start <= len(path); {
+
+		end := strings.IndexByte(path[start:], '.')
+		if end < 0 {
+			end = len(path)
+		} else {
+			end += start
+		}
+
+		offset := buffer.Offset()
+
+		t, err = c.step(&buffer, t, path[start:end])
+		if err != nil {
+			return nil, withPathElement(decodeError(err, offset, t), path[:end])
+		}
+
+		start = end + 1
+	}
+
+	result, err := c.readDynamicField(&buffer, t)
+	if err != nil {
+		err = decodeError(err, buffer.Offset(), t)
+		if path != "" {
+			err = withPathElement(err, path)
+		}
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// step moves buffer from a value of type t to its element name. returns type of the element
+func (c *decode_context) step(buffer *decode_buffer, t uint16, name string) (uint16, error) {
+
+	// pointers and interfaces are followed to values they hold. every hop is a level
+	// of depth, which is not left until the next message, so cycles hit the depth limit
+	for t == uint16(reflect.Ptr) || t == uint16(reflect.Interface) {
+
+		err := c.enter(buffer, t)
+		if err != nil {
+			return t, err
+		}
+
+		var held uint16
+		err = buffer.ReadUint16(&held)
+		if err == nil {
+			err = buffer.ReadUint16(&c.dataBuffer.uint16val)
+		}
+		if err != nil {
+			return t, err
+		}
+
+		if held == 0 {
+			return t, errorf(ErrPathNotFound, "nil %s has no element %q", TypeName(t), name)
+		}
+
+		refBytes, offset, err := c.references.Get(uint64(c.dataBuffer.uint16val))
+		if err != nil {
+			return t, err
+		}
+
+		*buffer = buffer.InitBranch(refBytes, offset)
+		t = held
+	}
+
+	if isArrayType(t) {
+		return c.stepArray(buffer, t, name)
+	}
+
+	if t > internalTypesCount {
+		return c.stepStruct(buffer, t, name)
+	}
+
+	if t == uint16(reflect.Map) {
+		return c.stepMap(buffer, name)
+	}
+
+	return t, errorf(ErrPathNotFound, "%s has no element %q", TypeName(t), name)
+}
+
+// stepStruct skips fields before the named one, as their sizes are known
+func (c *decode_context) stepStruct(buffer *decode_buffer, t uint16, name string) (uint16, error) {
+
+	def, ok := c.definition(t)
+	if !ok {
+		return t, errorf(ErrUnknownType, "no definition for structure %d", t)
+	}
+
+	skip := 0
+	for i := range def.Fields {
+
+		f := &def.Fields[i]
+
+		if f.Name == name {
+			return f.Type, buffer.Next(skip)
+		}
+
+		skip += f.Size
+	}
+
+	return t, errorf(ErrPathNotFound, "structure %d has no field %q", t, name)
+}
+
+func (c *decode_context) stepArray(buffer *decode_buffer, t uint16, name string) (uint16, error) {
+
+	index, err := strconv.Atoi(name)
+	if err != nil || index < 0 {
+		return t, errorf(ErrPathNotFound, "%q is not an array index", name)
+	}
+
+	elementType := getArrayElementType(t)
+
+	typeSize, err := c.typeSize(elementType)
+	if err != nil {
+		return t, err
+	}
+
+	err = buffer.ReadUint16(&c.dataBuffer.uint16val)
+	if err != nil {
+		return t, err
+	}
+
+	arrayData, offset, err := c.references.Get(uint64(c.dataBuffer.uint16val))
+	if err != nil {
+		return t, err
+	}
+
+	if typeSize == 0 || len(arrayData)%typeSize != 0 {
+		return t, errorf(ErrMalformed, "array data length %d is not a multiple of element size %d", len(arrayData), typeSize)
+	}
+
+	items := len(arrayData) / typeSize
+	if index >= items {
+		return t, errorf(ErrPathNotFound, "index %d is out of %d elements", index, items)
+	}
+
+	start := index * typeSize
+	*buffer = buffer.InitBranch(arrayData[start:start+typeSize], offset+start)
+
+	return elementType, nil
+}
+
+// stepMap looks through map entries for the key written as name
+func (c *decode_context) stepMap(buffer *decode_buffer, name string) (uint16, error) {
+
+	t := uint16(reflect.Map)
+
+	var elType, keyType uint16
+
+	err := buffer.ReadUint16(&elType)
+	if err == nil {
+		err = buffer.ReadUint16(&keyType)
+	}
+	if err == nil {
+		err = buffer.ReadUint16(&c.dataBuffer.uint16val)
+	}
+	if err != nil {
+		return t, err
+	}
+
+	refBytes, offset, err := c.references.Get(uint64(c.dataBuffer.uint16val))
+	if err != nil {
+		return t, err
+	}
+
+	elemSize, err := c.typeSize(elType)
+	if err != nil {
+		return t, err
+	}
+
+	keySize, err := c.typeSize(keyType)
+	if err != nil {
+		return t, err
+	}
+
+	entrySize := keySize + elemSize
+	if entrySize == 0 || len(refBytes)%entrySize != 0 {
+		return t, errorf(ErrMalformed, "map data length %d doesn't match entry size %d", len(refBytes), entrySize)
+	}
+
+	for start := 0; start < len(refBytes); start += entrySize {
+
+		entry := buffer.InitBranch(refBytes[start:start+entrySize], offset+start)
+
+		found, err := c.matchKey(&entry, keyType, name)
+		if err != nil {
+			return t, err
+		}
+
+		// entry is left at the value
+		if found {
+			*buffer = entry
+			return elType, nil
+		}
+	}
+
+	return t, errorf(ErrPathNotFound, "map has no key %q", name)
+}
+
+// matchKey reads map key of type t and compares it with name
+func (c *decode_context) matchKey(buffer *decode_buffer, t uint16, name string) (bool, error) {
+
+	// string keys are compared without decoding them
+	if t == uint16(reflect.String) {
+		err := buffer.ReadUint16(&c.dataBuffer.uint16val)
+		if err != nil {
+			return false, err
+		}
+
+		key, _, err := c.references.Get(uint64(c.dataBuffer.uint16val))
+		if err != nil {
+			return false, err
+		}
+
+		return string(key) == name, nil
+	}
+
+	key, err := c.readDynamicField(buffer, t)
+	if err != nil {
+		return false, err
+	}
+
+	return toPathElement(key) == name, nil
+}
@@ -0,0 +1,177 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type routedMessage struct {
+	Headers map[string]string
+	Codes   map[int]ProductVal
+	Payload interface{}
+	Owner   *ProductVal
+	Data    []byte
+}
+
+func TestGet(t *testing.T) {
+
+	value := newTestStruct(5)
+	value.NestedStruct[3].Product.Price = 3.5
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		c := newTestCodec(t, order)
+
+		encoded, err := c.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+
+		cases := map[string]interface{}{
+			"NestedStruct.3.Product.Price": 3.5,
+			"NestedStruct.0.Product.Price": 10.95,
+			"NestedStruct.4.Product.Name":  "json binary self describing proto",
+			"NestedStruct.4.Fl2":           99.98765432,
+			"Id":                           int64(49),
+			"MapVal.Name":                  "serhii",
+			"StrVal":                       "holaAmigo grande!",
+			"NestedStruct.2.Product":       map[string]interface{}{"Name": "json binary self describing proto", "Price": 10.95},
+		}
+
+		for path, want := range cases {
+			got, err := ctx.Get(encoded, path)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("%s: want %#v, got %#v", path, want, got)
+			}
+		}
+
+		// empty path selects the whole message
+		root, err := ctx.Get(encoded, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		whole, err := ctx.DecodeDynamic(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(whole, root) {
+			t.Fatalf("root differs\nwant %v\ngot  %v", whole, root)
+		}
+	}
+}
+
+func TestGetReferences(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	encoded, err := c.Marshal(routedMessage{
+		Headers: map[string]string{"route": "orders", "trace": "abc"},
+		Codes:   map[int]ProductVal{7: {"seven", 7.5}},
+		Payload: ProductVal{"payload", 1},
+		Owner:   &ProductVal{"owner", 2},
+		Data:    []byte{1, 2, 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(c)
+
+	cases := map[string]interface{}{
+		"Headers.route":     "orders",
+		"Codes.7.Name":      "seven",
+		"Payload.Name":      "payload",
+		"Owner.Price":       2.0,
+		"Data.2":            int64(3),
+		"Data":              []byte{1, 2, 3},
+		"Payload":           map[string]interface{}{"Name": "payload", "Price": 1.0},
+		"Codes.7":           map[string]interface{}{"Name": "seven", "Price": 7.5},
+		"Headers.trace":     "abc",
+		"Owner":             map[string]interface{}{"Name": "owner", "Price": 2.0},
+		"Headers":           map[string]interface{}{"route": "orders", "trace": "abc"},
+		"Codes.7.Price":     7.5,
+		"Payload.Price":     1.0,
+		"Owner.Name":        "owner",
+		"Codes":             map[interface{}]interface{}{int64(7): map[string]interface{}{"Name": "seven", "Price": 7.5}},
+		"Data.0":            int64(1),
+		"Headers.route.":    nil,
+		"Codes.8":           nil,
+		"Payload.Missing":   nil,
+		"Data.3":            nil,
+		"Data.-1":           nil,
+		"Owner.Name.Length": nil,
+	}
+
+	for path, want := range cases {
+
+		got, err := ctx.Get(encoded, path)
+
+		// nil marks paths, which are not in the message
+		if want == nil {
+			var decErr *DecodeError
+			if !errors.Is(err, ErrPathNotFound) || !errors.As(err, &decErr) {
+				t.Fatalf("%s: expected ErrPathNotFound, got %v, %v", path, got, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("%s: want %#v, got %#v", path, want, got)
+		}
+	}
+}
+
+func TestGetNilPointer(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(routedMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(c)
+
+	owner, err := ctx.Get(encoded, "Owner")
+	if err != nil || owner != nil {
+		t.Fatalf("nil pointer decoded as %v, %v", owner, err)
+	}
+
+	_, err = ctx.Get(encoded, "Owner.Name")
+	if !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) || decErr.FieldPath != "Owner.Name" {
+		t.Fatalf("unexpected error path in %v", err)
+	}
+}
+
+func TestGetSelfReference(t *testing.T) {
+
+	for _, o := range []DecodeOptions{DefaultDecodeOptions, {}} {
+
+		ctx := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+		ctx.SetOptions(o)
+
+		// interface holding itself is followed until the depth limit
+		_, err := ctx.Get(selfReferencingInterface(), "Name")
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("MaxDepth %d: expected ErrLimitExceeded, got %v", o.MaxDepth, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// optional message header, precedes structure definitions
+// [magic;4b][format version;1b][byte order;1b][reference width in bits;1b][feature flags;1b]
+
+const messageHeaderSize = 8
+
+// FormatVersion is the latest format version codec is able to write and read
+const FormatVersion uint8 = 1
+
+const (
+	orderLittleEndian uint8 = 1
+	orderBigEndian    uint8 = 2
+)
+
+// width of reference ids in bits
+const referenceWidth uint8 = 16
+
+// feature flags
+const (
+	// message carries structure definitions
+	featureSchema uint8 = 1 << iota
+	// pointers could refer to values written before, see EncodeOptions.TrackPointers
+	featurePointers
+	// message is canonical, structures are numbered in order of their use
+	featureCanonical
+)
+
+const knownFeatures = featureSchema | featurePointers | featureCanonical
+
+var messageMagic = []byte{'T', 'R', 'B', 'N'}
+
+type messageHeader struct {
+	Version        uint8
+	Order          binary.ByteOrder
+	ReferenceWidth uint8
+	Features       uint8
+}
+
+func byteOrderCode(order binary.ByteOrder) uint8 {
+	if order == binary.BigEndian {
+		return orderBigEndian
+	}
+	return orderLittleEndian
+}
+
+func (c *encode_context) writeMessageHeader(buffer encode_buffer, full bool) {
+
+	var features uint8
+	if full {
+		features |= featureSchema
+	}
+	if c.options.TrackPointers {
+		features |= featurePointers
+	}
+	if c.options.Canonical {
+		features |= featureCanonical
+	}
+
+	buffer.Write(messageMagic)
+	buffer.WriteByte(FormatVersion)
+	buffer.WriteByte(byteOrderCode(c.global.order))
+	buffer.WriteByte(referenceWidth)
+	buffer.WriteByte(features)
+}
+
+// HeaderMode tells decoder whether messages have a header
+type HeaderMode uint8
+
+const (
+	// header is recognized by its magic bytes. a message without a header, which
+	// starts with the same bytes, is read as having one and most likely rejected
+	HeaderAuto HeaderMode = iota
+	// messages without a header are rejected
+	HeaderRequired
+	// messages have no header, whatever bytes they start with
+	HeaderAbsent
+)
+
+// hasMessageHeader tells if input starts with the magic bytes of a header.
+// messages without a header could start with them as well, see HeaderMode
+func hasMessageHeader(input []byte) bool {
+	return len(input) >= messageHeaderSize && bytes.Equal(input[:len(messageMagic)], messageMagic)
+}
+
+// readMessageHeader consumes message header if input has one.
+// returns false for messages without a header
+func (c *decode_context) readMessageHeader(input []byte) (header messageHeader, present bool, err error) {
+
+	switch {
+	case c.options.Header == HeaderAbsent:
+		return
+	case hasMessageHeader(input):
+	case c.options.Header == HeaderRequired:
+		err = errorf(ErrIncompatibleFormat, "message has no header")
+		return
+	default:
+		return
+	}
+
+	present = true
+
+	header.Version = input[4]
+	header.ReferenceWidth = input[6]
+	header.Features = input[7]
+
+	if header.Version == 0 || header.Version > FormatVersion {
+		err = errorf(ErrIncompatibleFormat, "format version %d, supported up to %d", header.Version, FormatVersion)
+		return
+	}
+
+	switch input[5] {
+	case orderLittleEndian:
+		header.Order = binary.LittleEndian
+	case orderBigEndian:
+		header.Order = binary.BigEndian
+	default:
+		err = errorf(ErrIncompatibleFormat, "unknown byte order %d", input[5])
+		return
+	}
+
+	if header.ReferenceWidth != referenceWidth {
+		err = errorf(ErrIncompatibleFormat, "reference width %d bits, supported %d", header.ReferenceWidth, referenceWidth)
+		return
+	}
+
+	if header.Features&^knownFeatures != 0 {
+		err = errorf(ErrIncompatibleFormat, "unknown feature flags %08b", header.Features&^knownFeatures)
+		return
+	}
+
+	err = c.buffer.Next(messageHeaderSize)
+
+	return
+}
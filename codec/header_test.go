@@ -0,0 +1,195 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMessageHeaderRejected(t *testing.T) {
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(ProductVal{"header", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		offset int
+		value  byte
+	}{
+		"version 0":          {4, 0},
+		"future version":     {4, FormatVersion + 1},
+		"unknown byte order": {5, 3},
+		"no byte order":      {5, 0},
+		"reference width":    {6, 32},
+		"unknown feature":    {7, featureSchema | 1<<7},
+	}
+
+	for name, tc := range cases {
+
+		message := append([]byte(nil), encoded...)
+		message[tc.offset] = tc.value
+
+		var out ProductVal
+		err = newTestCodec(t, binary.LittleEndian).Unmarshal(message, &out)
+		if !errors.Is(err, ErrIncompatibleFormat) {
+			t.Fatalf("%s: expected ErrIncompatibleFormat, got %v", name, err)
+		}
+	}
+}
+
+func TestMessageHeaderMode(t *testing.T) {
+
+	value := ProductVal{"header", 1}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	withHeader, err := c.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewEncodeContext(c)
+	ctx.SetOptions(EncodeOptions{})
+
+	without, err := ctx.EncodeFullCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		mode    HeaderMode
+		message []byte
+		ok      bool
+	}{
+		{HeaderAuto, withHeader, true},
+		{HeaderAuto, without, true},
+		{HeaderRequired, withHeader, true},
+		{HeaderRequired, without, false},
+		{HeaderAbsent, without, true},
+		{HeaderAbsent, withHeader, false},
+	}
+
+	for i, tc := range cases {
+
+		dec := NewDecodeContext(c)
+		dec.SetOptions(DecodeOptions{Header: tc.mode})
+
+		var out ProductVal
+		err = dec.Decode(&out, tc.message)
+
+		if tc.ok && (err != nil || !reflect.DeepEqual(value, out)) {
+			t.Fatalf("case %d: decoded %+v, %v", i, out, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("case %d: message is decoded", i)
+		}
+	}
+
+	_, err = NewDecodeContext(c).readMessage(without)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	required := NewDecodeContext(c)
+	required.SetOptions(DecodeOptions{Header: HeaderRequired})
+
+	_, err = required.readMessage(without)
+	if !errors.Is(err, ErrIncompatibleFormat) {
+		t.Fatalf("expected ErrIncompatibleFormat, got %v", err)
+	}
+}
+
+// message without a header, which starts with the magic bytes, is ambiguous
+func TestMessageHeaderAmbiguous(t *testing.T) {
+
+	// 84 definitions, the first one has id "RB" and 78 fields
+	message := append([]byte(nil), messageMagic...)
+	message = append(message, make([]byte, 64)...)
+
+	auto := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+
+	_, err := auto.readMessage(message)
+	if !errors.Is(err, ErrIncompatibleFormat) {
+		t.Fatalf("expected the message to be read as having a header, got %v", err)
+	}
+
+	absent := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+	absent.SetOptions(DecodeOptions{Header: HeaderAbsent})
+
+	// definitions are read instead, fields of type 0 are invalid
+	_, err = absent.readMessage(message)
+	if err == nil || errors.Is(err, ErrIncompatibleFormat) {
+		t.Fatalf("expected the message to be read as definitions, got %v", err)
+	}
+
+	if absent.hasHeader || len(absent.messageTypes) == 0 || absent.messageTypes[0] != binary.LittleEndian.Uint16([]byte("RB")) {
+		t.Fatalf("unexpected definitions %v", absent.messageTypes)
+	}
+}
+
+func TestMessageHeaderFeatures(t *testing.T) {
+
+	value := &treeNode{Name: "features"}
+
+	cases := []struct {
+		options  EncodeOptions
+		full     bool
+		features uint8
+	}{
+		{EncodeOptions{Header: true}, false, 0},
+		{EncodeOptions{Header: true}, true, featureSchema},
+		{EncodeOptions{Header: true, TrackPointers: true}, true, featureSchema | featurePointers},
+		{EncodeOptions{Header: true, Canonical: true}, true, featureSchema | featureCanonical},
+		{EncodeOptions{Header: true, Canonical: true, TrackPointers: true}, true, featureSchema | featurePointers | featureCanonical},
+		{EncodeOptions{Header: true, Canonical: true}, false, featureSchema | featureCanonical},
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	for i, tc := range cases {
+
+		ctx := NewEncodeContext(c)
+		ctx.SetOptions(tc.options)
+
+		var encoded []byte
+		var err error
+
+		if tc.full {
+			encoded, err = ctx.EncodeFullCopy(value)
+		} else {
+			encoded, err = ctx.EncodeCopy(value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if encoded[7] != tc.features {
+			t.Fatalf("case %d: features %08b, expected %08b", i, encoded[7], tc.features)
+		}
+
+		var out treeNode
+		err = c.Unmarshal(encoded, &out)
+		if err != nil || out.Name != value.Name {
+			t.Fatalf("case %d: decoded %+v, %v", i, out, err)
+		}
+
+		// features added later are rejected by this version
+		for bit := uint(0); bit < 8; bit++ {
+
+			flag := uint8(1) << bit
+			if knownFeatures&flag != 0 {
+				continue
+			}
+
+			message := append([]byte(nil), encoded...)
+			message[7] |= flag
+
+			err = c.Unmarshal(message, &out)
+			if !errors.Is(err, ErrIncompatibleFormat) {
+				t.Fatalf("case %d: feature %08b: expected ErrIncompatibleFormat, got %v", i, flag, err)
+			}
+		}
+	}
+}
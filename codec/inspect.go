@@ -0,0 +1,133 @@
+package codec
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strconv"
+)
+
+// MessageInfo describes layout of an encoded message
+type MessageInfo struct {
+	// Header is nil for messages encoded without a header
+	Header *HeaderInfo
+
+	// structures defined by the message, in wire order
+	Types []TypeInfo
+
+	RootType uint16
+
+	// offset and size of the root element data
+	DataOffset int
+	DataSize   int
+
+	ReferencesOffset int
+	References       []ReferenceInfo
+}
+
+type HeaderInfo struct {
+	Version        uint8
+	Order          binary.ByteOrder
+	ReferenceWidth uint8
+	Features       uint8
+}
+
+type TypeInfo struct {
+	Id     uint16
+	Size   int
+	Fields []FieldInfo
+}
+
+type FieldInfo struct {
+	Name string
+	Type uint16
+	Size int
+}
+
+type ReferenceInfo struct {
+	Id uint16
+
+	// offset of the entry from the start of the message, including its length prefix
+	Offset int
+	Length int
+}
+
+// Inspect parses message header, structure definitions and references table
+// without decoding any values. definitions of the message are kept by a pooled
+// decode context and dropped when it is released, so data only messages could be
+// inspected only if their structures are registered in the codec
+func (c *codec) Inspect(input []byte) (*MessageInfo, error) {
+
+	ctx := c.AcquireDecoder()
+	defer ctx.Release()
+
+	rootType, err := ctx.readMessage(input)
+	if err != nil {
+		return nil, decodeError(err, ctx.buffer.Offset(), 0)
+	}
+
+	result := &MessageInfo{RootType: rootType}
+
+	if ctx.hasHeader {
+		result.Header = &HeaderInfo{
+			Version:        ctx.header.Version,
+			Order:          ctx.header.Order,
+			ReferenceWidth: ctx.header.ReferenceWidth,
+			Features:       ctx.header.Features,
+		}
+	}
+
+	for _, id := range ctx.messageTypes {
+
+		def, ok := ctx.definition(id)
+		if !ok {
+			return nil, errorf(ErrUnknownType, "no definition for structure %d", id)
+		}
+
+		typeInfo := TypeInfo{Id: def.Id, Size: def.Size, Fields: make([]FieldInfo, def.FieldCount)}
+
+		for i := 0; i < int(def.FieldCount); i++ {
+			f := &def.Fields[i]
+			typeInfo.Fields[i] = FieldInfo{Name: f.Name, Type: f.Type, Size: f.Size}
+		}
+
+		result.Types = append(result.Types, typeInfo)
+	}
+
+	result.DataOffset = ctx.buffer.Offset()
+	result.DataSize, _ = ctx.typeSize(rootType)
+	result.ReferencesOffset = result.DataOffset + result.DataSize
+
+	for id := uint64(1); id <= ctx.references.refsCount; id++ {
+
+		data, offset, err := ctx.references.Get(id)
+		if err != nil {
+			return nil, decodeError(err, result.ReferencesOffset, 0)
+		}
+
+		result.References = append(result.References, ReferenceInfo{
+			Id:     uint16(id),
+			Offset: offset - 2,
+			Length: len(data),
+		})
+	}
+
+	return result, nil
+}
+
+// TypeName returns readable name of a wire type id
+func TypeName(t uint16) string {
+
+	if isArrayType(t) {
+		return "[]" + TypeName(getArrayElementType(t))
+	}
+
+	if t > internalTypesCount {
+		return "struct#" + strconv.Itoa(int(t))
+	}
+
+	if t == 0 {
+		return "nil"
+	}
+
+	return reflect.Kind(t).String()
+}
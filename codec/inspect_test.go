@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+
+	c := newTestCodec(t, binary.BigEndian)
+
+	encoded, err := c.Marshal(newTestStruct(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := newTestCodec(t, binary.LittleEndian).Inspect(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Header == nil || info.Header.Order != binary.BigEndian || info.Header.Version != FormatVersion {
+		t.Fatalf("unexpected header %+v", info.Header)
+	}
+
+	// dependencies are defined first
+	if len(info.Types) != 4 {
+		t.Fatalf("expected 4 types, got %d", len(info.Types))
+	}
+
+	root := info.Types[len(info.Types)-1]
+	if root.Id != info.RootType {
+		t.Fatalf("root type %d is not defined last", info.RootType)
+	}
+
+	names := []string{"Id", "Value", "NestedStruct", "MapVal", "StrVal"}
+	if len(root.Fields) != len(names) {
+		t.Fatalf("expected %d root fields, got %d", len(names), len(root.Fields))
+	}
+	for i, name := range names {
+		if root.Fields[i].Name != name {
+			t.Fatalf("field %d: expected %s, got %s", i, name, root.Fields[i].Name)
+		}
+	}
+
+	if info.DataOffset+info.DataSize != info.ReferencesOffset {
+		t.Fatalf("references don't follow data: %+v", info)
+	}
+
+	end := info.ReferencesOffset
+	for _, ref := range info.References {
+		if ref.Offset != end {
+			t.Fatalf("reference %d at %d, expected %d", ref.Id, ref.Offset, end)
+		}
+		end += 2 + ref.Length
+	}
+
+	if end != len(encoded) {
+		t.Fatalf("references end at %d, message length %d", end, len(encoded))
+	}
+
+	if TypeName(setArrayTypeFlag(root.Id)) != "[]struct#28" {
+		t.Fatalf("unexpected type name %s", TypeName(setArrayTypeFlag(root.Id)))
+	}
+}
+
+func TestInspectKeepsNoDefinitions(t *testing.T) {
+
+	sender := newTestCodec(t, binary.LittleEndian)
+	value := newTestStruct(2)
+
+	full, err := sender.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataOnly, err := NewEncodeContext(sender).EncodeCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	_, err = c.Inspect(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// definitions of the full message are gone with its context
+	_, err = c.Inspect(dataOnly)
+	if !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+
+	// registered ones are known
+	_, err = c.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Inspect(dataOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
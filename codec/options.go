@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"github.com/dot5enko/transbin/utils"
+	"reflect"
+)
+
+// EncodeOptions controls optional parts of encoded messages
+type EncodeOptions struct {
+	// prepend message header with magic bytes, format version,
+	// byte order, reference width and feature flags. enabled by default,
+	// messages without it could be decoded only by a codec with the same byte order
+	Header bool
+
+	// numeric fields are read through unsafe pointers at cached offsets instead of reflection.
+	// applies to addressable structures only, pass values to encode by pointer
+	UnsafeFieldAccess bool
+
+	// equal values are always encoded to the same bytes, so messages could be hashed,
+	// signed or compared. map keys are sorted and structures are numbered in order
+	// of their use within a message, all definitions are included even in streams
+	// and data only encodes
+	Canonical bool
+
+	// repeated strings and byte slices share one reference instead of being
+	// written for every occurrence. decoders need no support for it
+	Deduplicate bool
+
+	// pointers met more than once, including cyclic ones and the ones in slices, maps
+	// and interfaces, are written as references to the first occurrence, so decoders
+	// rebuild shared and cyclic pointers. otherwise every pointer is written as a copy
+	// of its value and cycles fail to encode with ErrCyclicValue
+	TrackPointers bool
+}
+
+// SetEncodeOptions sets options for contexts created by the codec afterwards,
+// including pooled ones. should be called before codec is shared between goroutines
+func (c *codec) SetEncodeOptions(o EncodeOptions) {
+	c.encodeOptions = o
+}
+
+// SetOptions overrides codec's encode options for this context only
+func (c *encode_context) SetOptions(o EncodeOptions) {
+	c.options = o
+}
+
+// DecodeOptions limits resources decoder may spend on a single message,
+// so payloads from untrusted sources could be decoded safely. zero means no limit
+type DecodeOptions struct {
+	// structure definitions in a message header
+	MaxTypes int
+	// structure definitions a context keeps from all messages it decoded, other than
+	// the registered ones. streams and reused contexts accumulate them until Reset
+	MaxDefinedTypes int
+	// fields in a single structure definition
+	MaxFields int
+	// elements in a decoded slice or entries in a decoded map
+	MaxSliceLength int
+	// bytes allocated for slices, maps and strings of a message
+	MaxAlloc int
+	// nesting of values, a structure field and a pointer or an interface count
+	// as a level each. zero or values over 10000 mean 10000, which is always applied
+	MaxDepth int
+	// size of a frame accepted by stream decoder
+	MaxMessageSize int
+
+	// whether messages have a header, by default it is recognized by its magic bytes
+	Header HeaderMode
+
+	// notified about decoder allocations, nil disables instrumentation
+	Observer DecodeObserver
+
+	// decoded strings point into the input instead of being copied.
+	// input must stay alive and unchanged as long as any decoded string is in use,
+	// otherwise strings will change under the caller
+	ZeroCopyStrings bool
+
+	// numeric fields are written through unsafe pointers at cached offsets instead of reflection
+	UnsafeFieldAccess bool
+}
+
+// DecodeObserver is an instrumentation hook for decoder allocations.
+// it is called synchronously on the decoding goroutine, so it should be cheap
+type DecodeObserver interface {
+	// Allocated is called before decoder allocates n bytes for a string, slice or map of type t
+	Allocated(t reflect.Type, n int)
+}
+
+// ReportAllocsObserver passes decoder allocations to utils.ReportAllocs,
+// which prints memory statistics while utils.Reporting is enabled
+type ReportAllocsObserver struct{}
+
+func (ReportAllocsObserver) Allocated(t reflect.Type, n int) {
+	utils.ReportAllocs(t.String())
+}
+
+// DefaultDecodeOptions are used by new codecs. references could be shared and cyclic,
+// and contexts keep definitions between messages, so depth, allocation
+// and defined types are always limited, set other limits for untrusted input.
+// depth is as deep as the decoder goes, so long pointer chains encoded by the codec are read back
+var DefaultDecodeOptions = DecodeOptions{
+	MaxDepth:        maxDecodeDepth,
+	MaxAlloc:        256 << 20,
+	MaxDefinedTypes: 4096,
+}
+
+// SetDecodeOptions sets options for decode contexts created by the codec afterwards,
+// including pooled ones. should be called before codec is shared between goroutines
+func (c *codec) SetDecodeOptions(o DecodeOptions) {
+	c.decodeOptions = o
+}
+
+// SetOptions overrides codec's decode options for this context only
+func (ctx *decode_context) SetOptions(o DecodeOptions) {
+	ctx.options = o
+}
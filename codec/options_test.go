@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type countingObserver struct {
+	calls map[reflect.Kind]int
+	bytes int
+}
+
+func (o *countingObserver) Allocated(t reflect.Type, n int) {
+	o.calls[t.Kind()]++
+	o.bytes += n
+}
+
+func TestDecodeObserver(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	original := newTestStruct(4)
+
+	encoded, err := c.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observer := &countingObserver{calls: make(map[reflect.Kind]int)}
+
+	ctx := NewDecodeContext(c)
+	ctx.SetOptions(DecodeOptions{Observer: observer})
+
+	var decoded TestStruct
+	err = ctx.Decode(&decoded, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// StrVal, MapVal.Name and a product name per nested struct
+	if observer.calls[reflect.String] != 2+len(original.NestedStruct) {
+		t.Fatalf("unexpected string allocations %d", observer.calls[reflect.String])
+	}
+
+	if observer.calls[reflect.Slice] != 1 {
+		t.Fatalf("unexpected slice allocations %d", observer.calls[reflect.Slice])
+	}
+
+	if observer.bytes != ctx.allocated {
+		t.Fatalf("observed %d bytes, accounted %d", observer.bytes, ctx.allocated)
+	}
+}
+
+func TestZeroCopyStrings(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(ProductVal{"zero copy", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(c)
+	ctx.SetOptions(DecodeOptions{ZeroCopyStrings: true})
+
+	var decoded ProductVal
+	err = ctx.Decode(&decoded, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Name != "zero copy" {
+		t.Fatalf("unexpected name %q", decoded.Name)
+	}
+
+	// string shares memory with the input
+	encoded[len(encoded)-1] = 'Y'
+	if decoded.Name != "zero copY" {
+		t.Fatalf("string doesn't alias input: %q", decoded.Name)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = ctx.Decode(&decoded, encoded)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %f", allocs)
+	}
+}
@@ -0,0 +1,483 @@
+package codec
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// structPlan is compiled once for a Go type and a structure definition.
+// fields keep their indexes, offsets and operations, so encoding and decoding
+// don't look definitions up and switch on field kinds for every value
+type structPlan struct {
+	def    *structDefinition
+	fields []fieldPlan
+}
+
+// fieldOp is a precomputed way to write or read a field
+type fieldOp uint8
+
+const (
+	// general way, dispatched on the wire type
+	opTyped fieldOp = iota
+	opReference
+	opNested
+	opArray
+	opPointer
+
+	// numeric operations go last, they could be done through unsafe pointers
+	opInt32
+	opFloat32
+	opFloat64
+)
+
+type fieldPlan struct {
+	// wire definition of the field, Offset is set to the offset of Go field
+	codecStructField
+
+	index int
+	op    fieldOp
+
+	// kind of Go field
+	kind reflect.Kind
+
+	// plan of a nested structure
+	nested *structPlan
+
+	// size of array elements
+	elemSize int
+
+	// pointer fields are allocated before decoding, unless they are pointers on the wire
+	pointer bool
+}
+
+// encodePlan returns a plan for writing structures of type t, registering it if needed
+func (c *codec) encodePlan(t reflect.Type) (*structPlan, error) {
+
+	if plan, ok := c.encodePlans.Load(t); ok {
+		return plan.(*structPlan), nil
+	}
+
+	def, err := c.registerStructure(t)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &structPlan{def: def, fields: make([]fieldPlan, def.FieldCount)}
+
+	for i := range plan.fields {
+
+		sf := t.Field(i)
+
+		fp := &plan.fields[i]
+		fp.codecStructField = def.Fields[i]
+		fp.Offset = sf.Offset
+		fp.index = i
+		fp.kind = sf.Type.Kind()
+
+		err = c.compileFieldEncoder(fp, sf.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stored, _ := c.encodePlans.LoadOrStore(t, plan)
+
+	return stored.(*structPlan), nil
+}
+
+func (c *codec) compileFieldEncoder(fp *fieldPlan, ft reflect.Type) (err error) {
+
+	if isArrayType(fp.Type) {
+		fp.op = opReference
+		return nil
+	}
+
+	if fp.Type > internalTypesCount {
+		fp.nested, err = c.encodePlan(ft)
+		fp.op = opNested
+		return err
+	}
+
+	switch reflect.Kind(fp.Type) {
+	case reflect.String, reflect.Map, reflect.Interface:
+		fp.op = opReference
+	case reflect.Ptr:
+		fp.op = opPointer
+	case reflect.Int, reflect.Int32:
+		fp.op = opInt32
+	case reflect.Float32:
+		fp.op = opFloat32
+	case reflect.Float64:
+		fp.op = opFloat64
+	default:
+		return &UnsupportedTypeError{ft}
+	}
+
+	return nil
+}
+
+func (c *encode_context) writePlanField(buffer encode_buffer, fp *fieldPlan, v reflect.Value) error {
+
+	switch fp.op {
+	case opInt32:
+		buffer.PutInt32(int32(v.Int()))
+	case opFloat32:
+		buffer.PutFloat32(float32(v.Float()))
+	case opFloat64:
+		buffer.PutFloat64(v.Float())
+	case opNested:
+		return c.writePlan(buffer, fp.nested, v)
+	case opPointer:
+		return c.writePointerFieldData(buffer, v)
+	default:
+		return c.writeReferenceFieldData(buffer, c.fieldType(&fp.codecStructField), v)
+	}
+
+	return nil
+}
+
+// writeFieldAt writes numeric field located at p
+func writeFieldAt(buffer encode_buffer, fp *fieldPlan, p unsafe.Pointer) {
+
+	switch fp.op {
+	case opInt32:
+		if fp.kind == reflect.Int {
+			buffer.PutInt32(int32(*(*int)(p)))
+		} else {
+			buffer.PutInt32(*(*int32)(p))
+		}
+	case opFloat32:
+		buffer.PutFloat32(*(*float32)(p))
+	case opFloat64:
+		buffer.PutFloat64(*(*float64)(p))
+	}
+}
+
+// writePlan writes fields of structure v, which should be of the plan's type
+func (c *encode_context) writePlan(buffer encode_buffer, plan *structPlan, v reflect.Value) error {
+
+	err := c.enter(v)
+	if err != nil {
+		return err
+	}
+
+	err = c.writePlanFields(buffer, plan, v)
+
+	c.leave(v)
+
+	return err
+}
+
+func (c *encode_context) writePlanFields(buffer encode_buffer, plan *structPlan, v reflect.Value) error {
+
+	var base unsafe.Pointer
+	if c.options.UnsafeFieldAccess && v.CanAddr() {
+		base = unsafe.Pointer(v.UnsafeAddr())
+	}
+
+	for i := range plan.fields {
+
+		fp := &plan.fields[i]
+
+		if base != nil && fp.op >= opInt32 {
+			writeFieldAt(buffer, fp, unsafe.Pointer(uintptr(base)+fp.Offset))
+			continue
+		}
+
+		err := c.writePlanField(buffer, fp, v.Field(fp.index))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planDefinitions resolves structures for decode plans, as seen by a codec or a decode context
+type planDefinitions interface {
+	definition(id uint16) (*structDefinition, bool)
+	typeSize(t uint16) (int, error)
+	decodePlan(def *structDefinition, t reflect.Type) (*structPlan, error)
+}
+
+// decodePlan returns a plan for reading registered structure def into values of type t.
+// fields are matched by position, as definitions could come from other codecs
+func (c *codec) decodePlan(def *structDefinition, t reflect.Type) (*structPlan, error) {
+
+	plans, ok := c.decodePlans.Load(def)
+	if !ok {
+		plans, _ = c.decodePlans.LoadOrStore(def, &sync.Map{})
+	}
+
+	byType := plans.(*sync.Map)
+
+	if plan, ok := byType.Load(t); ok {
+		return plan.(*structPlan), nil
+	}
+
+	plan, err := compileDecodePlan(c, def, t)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, _ := byType.LoadOrStore(t, plan)
+
+	return stored.(*structPlan), nil
+}
+
+// decodePlan returns a plan for reading structure def into values of type t.
+// contexts with definitions of their own compile plans with them and keep them
+// until definitions change, others share plans of the codec
+func (c *decode_context) decodePlan(def *structDefinition, t reflect.Type) (*structPlan, error) {
+
+	if len(c.overrides) == 0 && len(c.local) == 0 {
+		return c.global.decodePlan(def, t)
+	}
+
+	byType := c.plans[def]
+	if plan, ok := byType[t]; ok {
+		return plan, nil
+	}
+
+	plan, err := compileDecodePlan(c, def, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if byType == nil {
+		if c.plans == nil {
+			c.plans = make(map[*structDefinition]map[reflect.Type]*structPlan)
+		}
+
+		byType = make(map[reflect.Type]*structPlan)
+		c.plans[def] = byType
+	}
+
+	byType[t] = plan
+
+	return plan, nil
+}
+
+func compileDecodePlan(defs planDefinitions, def *structDefinition, t reflect.Type) (*structPlan, error) {
+
+	if int(def.FieldCount) > t.NumField() {
+		return nil, errorf(ErrTypeMismatch, "structure %d has %d fields, %s has only %d", def.Id, def.FieldCount, t, t.NumField())
+	}
+
+	plan := &structPlan{def: def, fields: make([]fieldPlan, def.FieldCount)}
+
+	for i := range plan.fields {
+
+		sf := t.Field(i)
+
+		fp := &plan.fields[i]
+		fp.codecStructField = def.Fields[i]
+		fp.Offset = sf.Offset
+		fp.index = i
+		fp.kind = sf.Type.Kind()
+		fp.pointer = fp.kind == reflect.Ptr && fp.Type != uint16(reflect.Ptr)
+
+		compileFieldDecoder(defs, fp, sf)
+	}
+
+	return plan, nil
+}
+
+// compileFieldDecoder picks a specialized operation when Go field matches the wire type,
+// anything else is left to readTypedData, which reports the mismatch
+func compileFieldDecoder(defs planDefinitions, fp *fieldPlan, sf reflect.StructField) {
+
+	fp.op = opTyped
+
+	ft := sf.Type
+
+	// unexported and pointer fields take the general way
+	if sf.PkgPath != "" || fp.pointer {
+		return
+	}
+
+	if isArrayType(fp.Type) {
+		size, err := defs.typeSize(getArrayElementType(fp.Type))
+		if err == nil && ft.Kind() == reflect.Slice {
+			fp.elemSize = size
+			fp.op = opArray
+		}
+		return
+	}
+
+	if fp.Type > internalTypesCount {
+		def, ok := defs.definition(fp.Type)
+		if !ok || ft.Kind() != reflect.Struct {
+			return
+		}
+
+		nested, err := defs.decodePlan(def, ft)
+		if err == nil {
+			fp.nested = nested
+			fp.op = opNested
+		}
+		return
+	}
+
+	switch reflect.Kind(fp.Type) {
+	case reflect.Int, reflect.Int32:
+		switch ft.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fp.op = opInt32
+		}
+	case reflect.Float32:
+		switch ft.Kind() {
+		case reflect.Float32, reflect.Float64:
+			fp.op = opFloat32
+		}
+	case reflect.Float64:
+		switch ft.Kind() {
+		case reflect.Float32, reflect.Float64:
+			fp.op = opFloat64
+		}
+	}
+}
+
+func (c *decode_context) readPlanField(buffer *decode_buffer, fp *fieldPlan, v reflect.Value) error {
+
+	switch fp.op {
+	case opInt32:
+		err := buffer.ReadInt32(&c.dataBuffer.int32val)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(c.dataBuffer.int32val))
+	case opFloat32:
+		err := buffer.ReadFloat32(&c.dataBuffer.float32val)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(c.dataBuffer.float32val))
+	case opFloat64:
+		err := buffer.ReadFloat64(&c.dataBuffer.float64val)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(c.dataBuffer.float64val)
+	case opNested:
+		return c.readPlan(buffer, fp.nested, v)
+	case opArray:
+		return c.readArray(buffer, getArrayElementType(fp.Type), fp.elemSize, v)
+	default:
+		return c.readTypedData(buffer, fp.codecStructField, v)
+	}
+
+	return nil
+}
+
+// readFieldAt reads numeric field located at p
+func (c *decode_context) readFieldAt(buffer *decode_buffer, fp *fieldPlan, p unsafe.Pointer) error {
+
+	switch fp.op {
+	case opInt32:
+		err := buffer.ReadInt32(&c.dataBuffer.int32val)
+		if err != nil {
+			return err
+		}
+
+		val := c.dataBuffer.int32val
+
+		switch fp.kind {
+		case reflect.Int:
+			*(*int)(p) = int(val)
+		case reflect.Int8:
+			*(*int8)(p) = int8(val)
+		case reflect.Int16:
+			*(*int16)(p) = int16(val)
+		case reflect.Int32:
+			*(*int32)(p) = val
+		case reflect.Int64:
+			*(*int64)(p) = int64(val)
+		}
+	case opFloat32, opFloat64:
+		var val float64
+
+		if fp.op == opFloat32 {
+			err := buffer.ReadFloat32(&c.dataBuffer.float32val)
+			if err != nil {
+				return err
+			}
+			val = float64(c.dataBuffer.float32val)
+		} else {
+			err := buffer.ReadFloat64(&c.dataBuffer.float64val)
+			if err != nil {
+				return err
+			}
+			val = c.dataBuffer.float64val
+		}
+
+		if fp.kind == reflect.Float32 {
+			*(*float32)(p) = float32(val)
+		} else {
+			*(*float64)(p) = val
+		}
+	}
+
+	return nil
+}
+
+// readPlan reads fields of structure v, which should be of the plan's type.
+// unexported structures are not written through pointers, as reflection refuses them
+func (c *decode_context) readPlan(buffer *decode_buffer, plan *structPlan, v reflect.Value) error {
+
+	var base unsafe.Pointer
+	if c.options.UnsafeFieldAccess && v.CanAddr() && v.CanSet() {
+		base = unsafe.Pointer(v.UnsafeAddr())
+	}
+
+	for i := range plan.fields {
+
+		fp := &plan.fields[i]
+
+		if base != nil && fp.op >= opInt32 {
+			err := c.enter(buffer, fp.Type)
+			if err != nil {
+				return withPathElement(err, fp.Name)
+			}
+
+			offset := buffer.Offset()
+
+			err = c.readFieldAt(buffer, fp, unsafe.Pointer(uintptr(base)+fp.Offset))
+
+			c.depth--
+
+			if err != nil {
+				return withPathElement(decodeError(err, offset, fp.Type), fp.Name)
+			}
+			continue
+		}
+
+		fieldObj := v.Field(fp.index)
+		if fp.pointer {
+			if !fieldObj.CanSet() {
+				return withPathElement(decodeError(errorf(ErrTypeMismatch, "unable to set unexported field of %s", v.Type()), buffer.Offset(), fp.Type), fp.Name)
+			}
+			if fieldObj.IsNil() {
+				fieldObj.Set(reflect.New(fieldObj.Type().Elem()))
+			}
+		}
+
+		err := c.enter(buffer, fp.Type)
+		if err != nil {
+			return withPathElement(err, fp.Name)
+		}
+
+		offset := buffer.Offset()
+
+		err = c.readPlanField(buffer, fp, fieldObj)
+
+		c.depth--
+
+		if err != nil {
+			return withPathElement(decodeError(err, offset, fp.Type), fp.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncodePlanCached(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	nestedType := reflect.TypeOf(NStruct{})
+
+	plan, err := c.encodePlan(nestedType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := c.encodePlan(nestedType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan != again {
+		t.Fatal("plan is compiled twice")
+	}
+
+	for i, fp := range plan.fields {
+		if fp.Offset != nestedType.Field(i).Offset {
+			t.Fatalf("field %s: offset %d, expected %d", fp.Name, fp.Offset, nestedType.Field(i).Offset)
+		}
+	}
+
+	product := plan.fields[len(plan.fields)-1]
+	if product.op != opNested || product.nested.def.Name != getTypeCode(reflect.TypeOf(ProductVal{})) {
+		t.Fatalf("nested structure is not planned: %+v", product)
+	}
+}
+
+func TestDecodePlanConversions(t *testing.T) {
+
+	type narrow struct {
+		A int32
+		B float32
+		C float64
+		D []ProductVal
+	}
+
+	type wide struct {
+		A int64
+		B float64
+		C float32
+		D []ProductVal
+		E string
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(narrow{-3, 1.5, 2.25, []ProductVal{{"a", 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded wide
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := wide{-3, 1.5, 2.25, []ProductVal{{"a", 1}}, ""}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", expected, decoded)
+	}
+}
+
+func TestUnsafeFieldAccess(t *testing.T) {
+
+	type ticks struct {
+		I8    int8
+		I16   int16
+		I32   int32
+		I64   int64
+		Float float32
+		Price float64
+		Name  string
+		Items []NStruct
+	}
+
+	type source struct {
+		I8    int32
+		I16   int32
+		I32   int32
+		I64   int
+		Float float32
+		Price float64
+		Name  string
+		Items []NStruct
+	}
+
+	original := source{-8, 16, -32, 64, 0.5, 10.95, "ticks", newTestStruct(3).NestedStruct}
+
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, UnsafeFieldAccess: true})
+
+	// structure passed by pointer is addressable, by value is not
+	for _, value := range []interface{}{&original, original} {
+
+		encoded, err := c.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := newTestCodec(t, binary.LittleEndian).Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(encoded, expected) {
+			t.Fatalf("%T: unsafe encoding differs", value)
+		}
+
+		decoder := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+		decoder.SetOptions(DecodeOptions{UnsafeFieldAccess: true})
+
+		var decoded ticks
+		err = decoder.Decode(&decoded, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := ticks{-8, 16, -32, 64, 0.5, 10.95, "ticks", original.Items}
+		if !reflect.DeepEqual(want, decoded) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", want, decoded)
+		}
+	}
+}
+
+func TestDecodePlanWithOverrides(t *testing.T) {
+
+	value := newCanonicalStruct()
+
+	encoded, err := newTestCodec(t, binary.LittleEndian).Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decoder has its own structures under ids of the message
+	c := newTestCodec(t, binary.LittleEndian)
+	_, err = c.Marshal(mixedStruct{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(c)
+
+	var plan *structPlan
+
+	for i := 0; i < 3; i++ {
+
+		var out canonicalStruct
+		err = ctx.Decode(&out, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(value, out) {
+			t.Fatalf("decoded value differs\nwant %+v\ngot  %+v", value, out)
+		}
+
+		// plans are compiled once with definitions of the context
+		var current *structPlan
+		for def, byType := range ctx.plans {
+			if p, ok := byType[reflect.TypeOf(out)]; ok && ctx.overrides[def.Id] == def {
+				current = p
+			}
+		}
+
+		if current == nil || plan != nil && current != plan {
+			t.Fatalf("decoding %d compiled plan %p, previous one is %p", i, current, plan)
+		}
+		plan = current
+	}
+
+	nested := plan.fields[len(plan.fields)-1]
+	if nested.op != opNested || nested.nested.def != ctx.overrides[nested.Type] {
+		t.Fatalf("nested structure is not planned with overridden definition: %+v", nested)
+	}
+
+	if _, ok := c.decodePlans.Load(plan.def); ok {
+		t.Fatal("plan of a message definition is cached by the codec")
+	}
+}
+
+type exportedProduct struct {
+	Name    string
+	Product ProductVal
+}
+
+type unexportedProduct struct {
+	Name    string
+	product ProductVal
+}
+
+// decodeUnexported decodes exportedProduct into a structure with the nested one unexported
+func decodeUnexported(t *testing.T, o DecodeOptions) (unexportedProduct, error) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	encoded, err := c.Marshal(exportedProduct{"outer", ProductVal{"inner", 2.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewDecodeContext(newTestCodec(t, binary.LittleEndian))
+	ctx.SetOptions(o)
+
+	var out unexportedProduct
+	err = ctx.Decode(&out, encoded)
+
+	return out, err
+}
+
+func TestDecodeUnexportedNested(t *testing.T) {
+
+	unsafeOptions := DefaultDecodeOptions
+	unsafeOptions.UnsafeFieldAccess = true
+
+	// fields are set through pointers or reflection the same way
+	for _, o := range []DecodeOptions{DefaultDecodeOptions, unsafeOptions} {
+
+		out, err := decodeUnexported(t, o)
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("unsafe %v: expected ErrTypeMismatch, got %v", o.UnsafeFieldAccess, err)
+		}
+
+		var decErr *DecodeError
+		if !errors.As(err, &decErr) || decErr.FieldPath != "Product" {
+			t.Fatalf("unsafe %v: unexpected error %v", o.UnsafeFieldAccess, err)
+		}
+
+		if out.product != (ProductVal{}) {
+			t.Fatalf("unsafe %v: unexported field is set to %+v", o.UnsafeFieldAccess, out.product)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package codec
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// pointer fields are written as [type of pointed value;2b][reference id;2b],
+// the reference holds the value. nil pointers have type 0 and no reference.
+// with EncodeOptions.TrackPointers pointers written before reuse their reference ids,
+// decoders keep pointers by reference ids, so shared and cyclic ones are rebuilt
+
+// wire type of slices of pointers, when they are tracked
+const pointerArrayType = 1<<15 | uint16(reflect.Ptr)
+
+// fieldType returns wire type of field f in messages of the context
+func (c *encode_context) fieldType(f *codecStructField) uint16 {
+
+	if f.Pointers && c.options.TrackPointers {
+		return pointerArrayType
+	}
+
+	return f.Type
+}
+
+// valueType returns wire type of map keys and values, interface values and array elements
+// of Go type t. tracked pointers are written as pointers there, not as values they point to
+func (c *encode_context) valueType(t reflect.Type) (uint16, error) {
+
+	if c.options.TrackPointers {
+		switch {
+		case t.Kind() == reflect.Ptr:
+			return uint16(reflect.Ptr), nil
+		case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Ptr:
+			return pointerArrayType, nil
+		}
+	}
+
+	return c.global.getType(t)
+}
+
+// pointerKey tells pointers apart, as a structure and its first field have the same address
+type pointerKey struct {
+	addr uintptr
+	t    reflect.Type
+}
+
+// values nested deeper are checked for cycles. untracked cycles would be written
+// until references overflow, while checking every value slows down encoding
+const cycleCheckDepth = 100
+
+// enter accounts structure or map v about to be written, callers leave it when done
+func (c *encode_context) enter(v reflect.Value) error {
+
+	c.depth++
+	if c.depth <= cycleCheckDepth {
+		return nil
+	}
+
+	key, ok := visitKey(v)
+	if !ok {
+		return nil
+	}
+
+	if c.visiting[key] {
+		c.depth--
+		return errorf(ErrCyclicValue, "%s contains itself, it could be encoded only with TrackPointers", v.Type())
+	}
+
+	if c.visiting == nil {
+		c.visiting = make(map[pointerKey]bool)
+	}
+	c.visiting[key] = true
+
+	return nil
+}
+
+func (c *encode_context) leave(v reflect.Value) {
+
+	if c.depth > cycleCheckDepth {
+		if key, ok := visitKey(v); ok {
+			delete(c.visiting, key)
+		}
+	}
+
+	c.depth--
+}
+
+// visitKey identifies structure or map v in memory. values could contain themselves
+// only through pointers, so structures which are not addressable are not in cycles
+func visitKey(v reflect.Value) (pointerKey, bool) {
+
+	switch {
+	case v.Kind() == reflect.Map:
+		return pointerKey{v.Pointer(), v.Type()}, true
+	case v.CanAddr():
+		return pointerKey{v.UnsafeAddr(), v.Type()}, true
+	}
+
+	return pointerKey{}, false
+}
+
+func (c *encode_context) writePointerFieldData(buffer encode_buffer, v reflect.Value) error {
+
+	// pointers to pointers are written as a single one
+	for !v.IsNil() && v.Elem().Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	if v.IsNil() {
+		buffer.PutUint16(0)
+		buffer.PutUint16(0)
+		return nil
+	}
+
+	elem := v.Elem()
+
+	t, err := c.global.getType(elem.Type())
+	if err != nil {
+		return err
+	}
+
+	c.useType(getArrayElementType(t))
+
+	buffer.PutUint16(c.wireType(t))
+
+	key := pointerKey{v.Pointer(), v.Type()}
+
+	if c.options.TrackPointers {
+		if id, ok := c.pointers[key]; ok {
+			buffer.PutUint16(id)
+			return nil
+		}
+	}
+
+	size, err := c.global.getTypeSize(t)
+	if err != nil {
+		return &UnsupportedTypeError{elem.Type()}
+	}
+
+	id := uint16(c.ref.GetId())
+
+	err = c.ref.putLength(size)
+	if err != nil {
+		return err
+	}
+
+	// remembered before the value is written, so cycles point back to it
+	if c.options.TrackPointers {
+		if c.pointers == nil {
+			c.pointers = make(map[pointerKey]uint16)
+		}
+		c.pointers[key] = id
+	}
+
+	_, err = c.encodeElementToBuffer(c.ref.buff.Branch(size), elem)
+	if err != nil {
+		return err
+	}
+
+	buffer.PutUint16(id)
+
+	return nil
+}
+
+// writePointerArray writes slice of pointers v as an array of pointer fields
+func (c *encode_context) writePointerArray(v reflect.Value) error {
+
+	size, _ := kindSize(uint16(reflect.Ptr))
+
+	allocate := v.Len() * size
+	if allocate > maxReferenceLength {
+		return errorf(ErrReferenceOverflow, "%s of %d elements takes %d bytes, over %d", v.Type(), v.Len(), allocate, maxReferenceLength)
+	}
+
+	c.ref.buff.PutUint16(uint16(allocate))
+
+	if allocate == 0 {
+		return nil
+	}
+
+	b := c.ref.buff.Branch(allocate)
+
+	for i := 0; i < v.Len(); i++ {
+		err := c.writePointerFieldData(b, v.Index(i))
+		if err != nil {
+			return withPathElement(err, strconv.Itoa(i))
+		}
+	}
+
+	return nil
+}
+
+func (c *decode_context) readPointerFieldData(buffer *decode_buffer, out reflect.Value) error {
+
+	var elemType uint16
+	err := buffer.ReadUint16(&elemType)
+	if err == nil {
+		err = buffer.ReadUint16(&c.dataBuffer.uint16val)
+	}
+	if err != nil {
+		return err
+	}
+
+	id := c.dataBuffer.uint16val
+
+	// interfaces holding pointers are set to decoded pointers of the same type
+	if out.Kind() == reflect.Interface && out.CanSet() && !out.IsNil() && out.Elem().Kind() == reflect.Ptr {
+		p := reflect.New(out.Elem().Type()).Elem()
+
+		err = c.readPointer(buffer, elemType, id, p)
+		if err == nil {
+			out.Set(p)
+		}
+
+		return err
+	}
+
+	return c.readPointer(buffer, elemType, id, out)
+}
+
+// readPointer sets pointer out to the value of reference id
+func (c *decode_context) readPointer(buffer *decode_buffer, elemType uint16, id uint16, out reflect.Value) error {
+
+	if out.Kind() != reflect.Ptr || !out.CanSet() {
+		return errorf(ErrTypeMismatch, "unable to decode pointer to %s", out.Type())
+	}
+
+	if elemType == 0 {
+		out.Set(reflect.Zero(out.Type()))
+		return nil
+	}
+
+	// pointers to pointers are allocated on the way
+	for out.Type().Elem().Kind() == reflect.Ptr {
+		if out.IsNil() {
+			out.Set(reflect.New(out.Type().Elem()))
+		}
+		out = out.Elem()
+	}
+
+	if p, ok := c.pointers[id]; ok {
+		if p.Type() != out.Type() {
+			return errorf(ErrTypeMismatch, "reference %d is decoded to %s, not %s", id, p.Type(), out.Type())
+		}
+
+		out.Set(p)
+		return nil
+	}
+
+	err := c.allocate(out.Type(), int(out.Type().Elem().Size()))
+	if err != nil {
+		return err
+	}
+
+	p := reflect.New(out.Type().Elem())
+	out.Set(p)
+
+	return c.readPointed(buffer, elemType, id, p)
+}
+
+// pointedValue returns value out points to, allocating nil pointers on the way.
+// interfaces holding non nil pointers are followed as well
+func (c *decode_context) pointedValue(out reflect.Value) (reflect.Value, error) {
+
+	for {
+		switch out.Kind() {
+		case reflect.Ptr:
+			if out.IsNil() {
+				if !out.CanSet() {
+					return out, errorf(ErrTypeMismatch, "unable to set unaccessible %s value", out.Type())
+				}
+
+				err := c.allocate(out.Type(), int(out.Type().Elem().Size()))
+				if err != nil {
+					return out, err
+				}
+
+				out.Set(reflect.New(out.Type().Elem()))
+			}
+		case reflect.Interface:
+			if out.IsNil() || out.Elem().Kind() != reflect.Ptr || out.Elem().IsNil() {
+				return out, nil
+			}
+		default:
+			return out, nil
+		}
+
+		out = out.Elem()
+	}
+}
+
+// readRootPointer reads root pointer into v, so the value could point back to v
+func (c *decode_context) readRootPointer(v reflect.Value) error {
+
+	// decoding to a pointer
+	if v.Elem().Kind() == reflect.Ptr {
+		fakeField := codecStructField{}
+		fakeField.Type = uint16(reflect.Ptr)
+
+		return c.readFieldData(c.buffer, fakeField, v.Elem())
+	}
+
+	var elemType uint16
+	err := c.buffer.ReadUint16(&elemType)
+	if err == nil {
+		err = c.buffer.ReadUint16(&c.dataBuffer.uint16val)
+	}
+	if err != nil {
+		return err
+	}
+
+	if elemType == 0 {
+		return errorf(ErrMalformed, "root pointer is nil")
+	}
+
+	return c.readPointed(c.buffer, elemType, c.dataBuffer.uint16val, v)
+}
+
+// readPointed reads value of pointer p from reference id
+func (c *decode_context) readPointed(buffer *decode_buffer, elemType uint16, id uint16, p reflect.Value) error {
+
+	refBytes, offset, err := c.references.Get(uint64(id))
+	if err != nil {
+		return err
+	}
+
+	// remembered before the value is read, so cycles point back to it
+	c.pointers[id] = p
+
+	fakeField := codecStructField{}
+	fakeField.Type = elemType
+
+	refBuffer := buffer.InitBranch(refBytes, offset)
+
+	return c.readFieldData(&refBuffer, fakeField, p.Elem())
+}
+
+func (c *decode_context) readDynamicPointer(buffer *decode_buffer) (interface{}, error) {
+
+	var elemType, id uint16
+	err := buffer.ReadUint16(&elemType)
+	if err == nil {
+		err = buffer.ReadUint16(&id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if elemType == 0 {
+		return nil, nil
+	}
+
+	if p, ok := c.pointers[id]; ok {
+		return p.Interface(), nil
+	}
+
+	refBytes, offset, err := c.references.Get(uint64(id))
+	if err != nil {
+		return nil, err
+	}
+
+	ref := buffer.InitBranch(refBytes, offset)
+
+	// structures are maps, which are remembered before they are filled,
+	// so cycles point back to them. other values are copied
+	if isArrayType(elemType) || elemType <= internalTypesCount {
+		return c.readDynamicField(&ref, elemType)
+	}
+
+	err = c.enter(&ref, elemType)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.readDynamicStruct(&ref, elemType, id)
+
+	c.depth--
+
+	if err != nil {
+		return nil, decodeError(err, offset, elemType)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,361 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type treeNode struct {
+	Name     string
+	Parent   *treeNode
+	Children []*treeNode
+}
+
+func newTestTree() *treeNode {
+
+	root := &treeNode{Name: "root"}
+
+	for _, name := range []string{"left", "right"} {
+		child := &treeNode{Name: name, Parent: root}
+		root.Children = append(root.Children, child)
+	}
+
+	right := root.Children[1]
+	right.Children = []*treeNode{{Name: "leaf", Parent: right}}
+
+	return root
+}
+
+func TestTrackPointersTree(t *testing.T) {
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		c := newTestCodec(t, order)
+		c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+		encoded, err := c.Marshal(newTestTree())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var root treeNode
+		err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if root.Name != "root" || root.Parent != nil || len(root.Children) != 2 {
+			t.Fatalf("unexpected root %+v", root)
+		}
+
+		for _, child := range root.Children {
+			if child.Parent != &root {
+				t.Fatalf("parent of %s is not the decoded root", child.Name)
+			}
+		}
+
+		right := root.Children[1]
+		if right.Name != "right" || len(right.Children) != 1 {
+			t.Fatalf("unexpected node %+v", right)
+		}
+
+		leaf := right.Children[0]
+		if leaf.Name != "leaf" || leaf.Parent != right || len(leaf.Children) != 0 {
+			t.Fatalf("unexpected leaf %+v", leaf)
+		}
+
+		// decoding to a pointer allocates the root
+		var rootPtr *treeNode
+		err = c.Unmarshal(encoded, &rootPtr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rootPtr == nil || rootPtr.Children[0].Parent != rootPtr {
+			t.Fatalf("root pointer is not rebuilt: %+v", rootPtr)
+		}
+	}
+}
+
+type sharedProducts struct {
+	First  *ProductVal
+	Second *ProductVal
+	Count  *int
+	None   *ProductVal
+}
+
+func TestTrackPointersShared(t *testing.T) {
+
+	count := 3
+	product := &ProductVal{"shared", 1.5}
+	original := sharedProducts{First: product, Second: product, Count: &count}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	copied, err := c.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewEncodeContext(c)
+	ctx.SetOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	tracked, err := ctx.EncodeFullCopy(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracked) >= len(copied) {
+		t.Fatalf("tracked message is %d bytes, copied one is %d", len(tracked), len(copied))
+	}
+
+	var out sharedProducts
+	err = c.Unmarshal(copied, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(original, out) || out.First == out.Second {
+		t.Fatalf("copied pointers decoded as %+v", out)
+	}
+
+	out = sharedProducts{}
+	err = c.Unmarshal(tracked, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(original, out) || out.First != out.Second {
+		t.Fatalf("shared pointers decoded as %+v", out)
+	}
+}
+
+func TestEncodeCycleWithoutTracking(t *testing.T) {
+
+	node := &treeNode{Name: "loop"}
+	node.Parent = node
+
+	sibling := &treeNode{Name: "sibling"}
+	sibling.Children = []*treeNode{{Name: "child"}, sibling}
+
+	self := map[string]interface{}{}
+	self["self"] = self
+
+	for name, value := range map[string]interface{}{"pointer": node, "slice": sibling, "map": self} {
+
+		_, err := newTestCodec(t, binary.LittleEndian).Marshal(value)
+		if !errors.Is(err, ErrCyclicValue) {
+			t.Fatalf("%s: expected ErrCyclicValue, got %v", name, err)
+		}
+	}
+
+	// pointers are tracked, maps are not
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	_, err := c.Marshal(sibling)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Marshal(self)
+	if !errors.Is(err, ErrCyclicValue) {
+		t.Fatalf("expected ErrCyclicValue, got %v", err)
+	}
+}
+
+type pointerContainers struct {
+	List  []*ProductVal
+	ByKey map[string]*ProductVal
+	Any   interface{}
+}
+
+func TestPointerContainers(t *testing.T) {
+
+	shared := &ProductVal{"shared", 1.5}
+
+	original := pointerContainers{
+		List:  []*ProductVal{shared, {"second", 2}, shared},
+		ByKey: map[string]*ProductVal{"a": shared, "b": {"b", 3}},
+		Any:   shared,
+	}
+
+	for _, track := range []bool{false, true} {
+
+		c := newTestCodec(t, binary.LittleEndian)
+		c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: track})
+
+		encoded, err := c.Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// values of interfaces are decoded into pointers they already hold
+		out := pointerContainers{Any: &ProductVal{}}
+
+		err = newTestCodec(t, binary.BigEndian).Unmarshal(encoded, &out)
+		if err != nil {
+			t.Fatalf("tracking %v: %v", track, err)
+		}
+
+		if !reflect.DeepEqual(original, out) {
+			t.Fatalf("tracking %v: decoded value differs\nwant %+v\ngot  %+v", track, original, out)
+		}
+
+		sharedOut := out.List[0] == out.List[2] && out.List[0] == out.ByKey["a"] && out.List[0] == out.Any
+		if sharedOut != track {
+			t.Fatalf("tracking %v: pointers are shared: %v", track, sharedOut)
+		}
+
+		decoded, err := NewDecodeContext(c).DecodeDynamic(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		byKey := decoded.(map[string]interface{})["ByKey"].(map[string]interface{})
+		if byKey["b"].(map[string]interface{})["Name"] != "b" {
+			t.Fatalf("tracking %v: map decoded dynamically as %v", track, byKey)
+		}
+	}
+}
+
+func TestPointerContainersNil(t *testing.T) {
+
+	original := pointerContainers{
+		List:  []*ProductVal{nil, {"second", 2}},
+		ByKey: map[string]*ProductVal{"nil": nil},
+		Any:   (*ProductVal)(nil),
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	// copies of nil pointers have nothing to copy
+	_, err := c.Marshal(original)
+	if !errors.Is(err, ErrNilPointer) {
+		t.Fatalf("expected ErrNilPointer, got %v", err)
+	}
+
+	c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	encoded, err := c.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := pointerContainers{Any: &ProductVal{}}
+
+	err = c.Unmarshal(encoded, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.List[0] != nil || out.List[1].Name != "second" || out.ByKey["nil"] != nil || len(out.ByKey) != 1 || out.Any.(*ProductVal) != nil {
+		t.Fatalf("nil pointers decoded as %+v", out)
+	}
+}
+
+func TestDecodePointerMismatch(t *testing.T) {
+
+	type otherProducts struct {
+		First  *ProductVal
+		Second *MapValStruct
+	}
+
+	product := &ProductVal{"shared", 1.5}
+
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	encoded, err := c.Marshal(sharedProducts{First: product, Second: product})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out otherProducts
+	err = c.Unmarshal(encoded, &out)
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+}
+
+func TestDecodeDynamicPointers(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	encoded, err := c.Marshal(newTestTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := NewDecodeContext(c).DecodeDynamic(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := decoded.(map[string]interface{})
+	if root["Name"] != "root" || root["Parent"] != nil {
+		t.Fatalf("unexpected root %v", root["Name"])
+	}
+
+	left := root["Children"].([]interface{})[0].(map[string]interface{})
+	if reflect.ValueOf(left["Parent"]).Pointer() != reflect.ValueOf(root).Pointer() {
+		t.Fatal("parent of a child is not the root map")
+	}
+}
+
+func TestTrackPointersDeep(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	c.SetEncodeOptions(EncodeOptions{Header: true, TrackPointers: true})
+
+	encoded, err := c.Marshal(newTestList(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list listNode
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestList(t, &list, 500)
+
+	// a branch of nodes pointing back to their parents
+	root := &treeNode{Name: "0"}
+	for node, i := root, 1; i < 200; i++ {
+		child := &treeNode{Name: strconv.Itoa(i), Parent: node}
+		node.Children = []*treeNode{child}
+		node = child
+	}
+
+	encoded, err = c.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tree treeNode
+	err = newTestCodec(t, binary.LittleEndian).Unmarshal(encoded, &tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, i := &tree, 0
+	for len(parent.Children) == 1 {
+		child := parent.Children[0]
+		i++
+
+		if child.Name != strconv.Itoa(i) || child.Parent != parent {
+			t.Fatalf("node %d is %+v", i, child)
+		}
+		parent = child
+	}
+
+	if i != 199 {
+		t.Fatalf("decoded %d levels", i)
+	}
+}
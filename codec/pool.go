@@ -0,0 +1,53 @@
+package codec
+
+// AcquireEncoder returns an encode context from the codec's pool.
+// a context is not safe for concurrent use, each goroutine should acquire its own
+// and Release it once the encoded bytes are no longer needed
+func (c *codec) AcquireEncoder() *encode_context {
+	ctx := c.encoders.Get().(*encode_context)
+
+	// codec options could change since the context was pooled
+	ctx.options = c.encodeOptions
+
+	return ctx
+}
+
+// Release resets the context and puts it back to the pool of its codec.
+// the context and any slices returned by it must not be used after Release
+func (c *encode_context) Release() {
+	c.Reset()
+	c.global.encoders.Put(c)
+}
+
+// AcquireDecoder returns a decode context from the codec's pool
+func (c *codec) AcquireDecoder() *decode_context {
+	ctx := c.decoders.Get().(*decode_context)
+	ctx.options = c.decodeOptions
+
+	return ctx
+}
+
+// Release resets the context and puts it back to the pool of its codec
+func (ctx *decode_context) Release() {
+	ctx.Reset()
+	ctx.global.decoders.Put(ctx)
+}
+
+// Marshal encodes v with full structure data using a pooled context.
+// returned slice is owned by the caller
+func (c *codec) Marshal(v interface{}) ([]byte, error) {
+
+	ctx := c.AcquireEncoder()
+	defer ctx.Release()
+
+	return ctx.EncodeFullCopy(v)
+}
+
+// Unmarshal decodes data into v using a pooled context. v should be a pointer
+func (c *codec) Unmarshal(data []byte, v interface{}) error {
+
+	ctx := c.AcquireDecoder()
+	defer ctx.Release()
+
+	return ctx.Decode(v, data)
+}
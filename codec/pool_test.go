@@ -0,0 +1,105 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestPoolReuse(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	value := newTestStruct(3)
+
+	expected, err := NewEncodeContext(c).EncodeFullCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pool may drop contexts, so reuse is only expected to happen at some point
+	reused := false
+
+	for i := 0; i < 100; i++ {
+
+		ctx := c.AcquireEncoder()
+
+		encoded, err := ctx.EncodeFull(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// released contexts keep nothing of previous messages
+		if !bytes.Equal(expected, encoded) {
+			t.Fatalf("message %d encoded by a pooled context differs", i)
+		}
+
+		ctx.Release()
+
+		next := c.AcquireEncoder()
+		reused = reused || next == ctx
+		next.Release()
+
+		dec := c.AcquireDecoder()
+
+		var out TestStruct
+		err = dec.Decode(&out, expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(value, out) {
+			t.Fatalf("message %d decoded by a pooled context differs", i)
+		}
+
+		dec.Release()
+	}
+
+	if !reused {
+		t.Fatal("released encode contexts are never reused")
+	}
+}
+
+func TestPoolOptionsReset(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	for i := 0; i < 100; i++ {
+
+		ctx := c.AcquireEncoder()
+		if ctx.options != c.encodeOptions {
+			t.Fatalf("acquired encoder has options %+v, codec has %+v", ctx.options, c.encodeOptions)
+		}
+
+		// options of a context are dropped with it
+		ctx.SetOptions(EncodeOptions{Canonical: true})
+		ctx.Release()
+
+		dec := c.AcquireDecoder()
+		if dec.options != c.decodeOptions {
+			t.Fatalf("acquired decoder has options %+v, codec has %+v", dec.options, c.decodeOptions)
+		}
+
+		dec.SetOptions(DecodeOptions{MaxDepth: 1})
+		dec.Release()
+	}
+
+	// codec options set after contexts were pooled apply to them
+	c.SetEncodeOptions(EncodeOptions{Header: true, Deduplicate: true})
+	c.SetDecodeOptions(DecodeOptions{MaxDepth: 8})
+
+	for i := 0; i < 100; i++ {
+
+		ctx := c.AcquireEncoder()
+		if !ctx.options.Deduplicate || ctx.options.Canonical {
+			t.Fatalf("acquired encoder has options %+v", ctx.options)
+		}
+		ctx.Release()
+
+		dec := c.AcquireDecoder()
+		if dec.options.MaxDepth != 8 {
+			t.Fatalf("acquired decoder has options %+v", dec.options)
+		}
+		dec.Release()
+	}
+}
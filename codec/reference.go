@@ -3,31 +3,34 @@ package codec
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
-	"github.com/dot5enko/transbin/utils"
 	"math"
 	"reflect"
-	"runtime"
-	"unsafe"
 )
 
+// referenced data length is written as uint16
+const maxReferenceLength = 65535
+
 type references_writer struct {
 	buff encode_buffer
 
 	count uint64
 	cap   uint64
 	order binary.ByteOrder
+
+	// ids of data written before, by its content. used when deduplicating
+	shared map[string]uint16
 }
 
 func NewReferencesWriter(addressWidth int, order binary.ByteOrder) (*references_writer, error) {
 	result := &references_writer{}
 
 	if addressWidth%8 != 0 {
-		return nil, utils.Error("Adress width should be a multiply of 8")
+		return nil, errors.New("Adress width should be a multiply of 8")
 	}
 
 	result.order = order
 	result.buff = NewEncodeBuffer(512, order)
+	result.shared = make(map[string]uint16)
 	result.cap = uint64(math.Pow(2, float64(addressWidth)) - 1)
 
 	result.Reset()
@@ -42,57 +45,125 @@ func (this *references_writer) GetId() uint64 {
 	this.count++
 	return cur
 }
-func (this *references_writer) Put(data []byte) error {
+
+// putLength starts a reference of length bytes
+func (this *references_writer) putLength(length int) error {
 
 	if this.count == this.cap {
-		return errors.New("You reached limit of references_writer. addressation overflow")
+		return errorf(ErrReferenceOverflow, "more than %d references", this.cap)
 	}
 
-	length := len(data)
-	if length > 65535 {
-		return errors.New("Length overflow")
+	if length > maxReferenceLength {
+		return errorf(ErrReferenceOverflow, "data length %d is over %d bytes", length, maxReferenceLength)
 	}
 
 	this.buff.PutUint16(uint16(length))
 
+	return nil
+}
+
+func (this *references_writer) Put(data []byte) error {
+
+	err := this.putLength(len(data))
+	if err != nil {
+		return err
+	}
+
 	actualLen, _ := this.buff.Write(data)
 
-	if actualLen != length {
+	if actualLen != len(data) {
 		return errors.New("Unable to write whole data")
 	}
 
 	return nil
 }
 
+// PutString writes string data without converting it to bytes
+func (this *references_writer) PutString(s string) error {
+
+	err := this.putLength(len(s))
+	if err != nil {
+		return err
+	}
+
+	this.buff.WriteString(s)
+
+	return nil
+}
+
 func (this *references_writer) Reset() {
 	this.buff.Reset()
 	this.count = 1
+
+	for key := range this.shared {
+		delete(this.shared, key)
+	}
+}
+
+// isBlob tells if v is a byte slice, written to references as it is
+func isBlob(t uint16, v reflect.Value) bool {
+	return t == setArrayTypeFlag(uint16(reflect.Uint8)) && v.Type().Elem().Kind() == reflect.Uint8
+}
+
+// sharedReference returns id of the same string or byte slice written before
+func (c *encode_context) sharedReference(t uint16, v reflect.Value) (id uint16, ok bool) {
+
+	switch {
+	case t == uint16(reflect.String):
+		id, ok = c.ref.shared[v.String()]
+	case isBlob(t, v):
+		// conversion in map index doesn't allocate
+		id, ok = c.ref.shared[string(sliceBytes(v, 1))]
+	}
+
+	return
+}
+
+// share remembers reference id of string or byte slice v
+func (c *encode_context) share(t uint16, v reflect.Value, id uint16) {
+
+	switch {
+	case t == uint16(reflect.String):
+		c.ref.shared[v.String()] = id
+	case isBlob(t, v):
+		// bytes could change after encoding, key is a copy
+		c.ref.shared[string(sliceBytes(v, 1))] = id
+	}
 }
 
 func (c *encode_context) writeArrayLikeData(v reflect.Value, parent_buf encode_buffer, cb func(n int, v reflect.Value, b encode_buffer) error) (sliceLength int, err error) {
 	sliceLength = v.Len()
 
 	var t uint16
-	t, err = c.global.getType(v.Type().Elem())
+	t, err = c.valueType(v.Type().Elem())
 	if err != nil {
 		return
 	}
 
 	var sizeOfElement int
 
-	sizeOfElement, _ = c.global.getTypeSize(t)
+	sizeOfElement, err = c.global.getTypeSize(t)
+	if err != nil {
+		return 0, &UnsupportedTypeError{v.Type().Elem()}
+	}
 
 	if v.Kind() == reflect.Map {
-		keyType, err := c.global.getType(v.Type().Key())
+		keyType, err := c.valueType(v.Type().Key())
 		if err != nil {
 			return 0, err
 		}
-		sizeOfKey, _ := c.global.getTypeSize(keyType)
+		sizeOfKey, err := c.global.getTypeSize(keyType)
+		if err != nil {
+			return 0, &UnsupportedTypeError{v.Type().Key()}
+		}
 		sizeOfElement += sizeOfKey
 
 	}
 
 	allocate := (sliceLength * sizeOfElement)
+	if allocate > maxReferenceLength {
+		return 0, errorf(ErrReferenceOverflow, "%s of %d elements takes %d bytes, over %d", v.Type(), sliceLength, allocate, maxReferenceLength)
+	}
 
 	// ref size
 	c.ref.buff.PutUint16(uint16(allocate))
@@ -107,17 +178,45 @@ func (c *encode_context) writeArrayLikeData(v reflect.Value, parent_buf encode_b
 	return
 }
 
-var curms runtime.MemStats
-var refsC uint64 = 0
-
 func (c *encode_context) putReference(buffer encode_buffer, t uint16, v reflect.Value) (reference uint16, err error) {
 
 	reference = uint16(c.ref.GetId())
 
-	if isArrayType(t) {
+	if t == pointerArrayType {
+		err = c.writePointerArray(v)
+	} else if isArrayType(t) {
 		at := getArrayElementType(t)
 		c.useType(at)
 		_, err = c.writeArrayLikeData(v, buffer, func(n int, v0 reflect.Value, b encode_buffer) error {
+
+			// numbers in host order and bytes are copied as they are
+			if size := bulkElementSize(at, v0.Type().Elem().Kind()); size == 1 || size > 0 && c.global.order == nativeOrder {
+				b.Write(sliceBytes(v0, size))
+				return nil
+			}
+
+			// structures share a plan, looked up once per array
+			if at > internalTypesCount {
+				plan, err := c.global.encodePlan(unrollPrt(v0.Type().Elem()))
+				if err != nil {
+					return err
+				}
+
+				for i := 0; i < n; i++ {
+					elem := reflect.Indirect(v0.Index(i))
+					if !elem.IsValid() {
+						return errorf(ErrNilPointer, "element %d of %s", i, v0.Type())
+					}
+
+					err = c.writePlan(b, plan, elem)
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}
+
 			var fakeField codecStructField
 			fakeField.Type = at
 
@@ -138,32 +237,35 @@ func (c *encode_context) putReference(buffer encode_buffer, t uint16, v reflect.
 		switch v.Kind() {
 		case reflect.String:
 
-			var vStr []byte
-
-			if v.CanAddr() {
-				vStr = *(*[]byte)(unsafe.Pointer(v.UnsafeAddr()))
-			} else {
-				vStr = []byte(v.String())
-			}
-
-			err = c.ref.Put([]byte(vStr))
+			err = c.ref.PutString(v.String())
 
 		case reflect.Interface:
 			// [type of ref data;2b;][ref id; 2b]
 
 			interfaceActualData := v.Elem()
 
+			// nil interface has no type and empty data
+			if !interfaceActualData.IsValid() {
+				buffer.PutUint16(0)
+				c.ref.buff.PutUint16(0)
+				return
+			}
+
 			var tCode uint16
-			tCode, err = c.global.getType(interfaceActualData.Type())
+			tCode, err = c.valueType(interfaceActualData.Type())
 			if err != nil {
 				return
 			}
 
 			// put type of referenced object
-			buffer.PutUint16(tCode)
+			buffer.PutUint16(c.wireType(tCode))
 
 			// allocated size in references_writer for actual data
-			allocate, _ := c.global.getTypeSize(tCode)
+			var allocate int
+			allocate, err = c.global.getTypeSize(tCode)
+			if err != nil {
+				return 0, &UnsupportedTypeError{interfaceActualData.Type()}
+			}
 			c.ref.buff.PutUint16(uint16(allocate))
 
 			// use allocated data
@@ -174,21 +276,51 @@ func (c *encode_context) putReference(buffer encode_buffer, t uint16, v reflect.
 
 			// [element type;2b][key type;2b][reference id; 2b] ... [name len;N;1b;][name bytes;Nb][fieldData;Xb]
 
-			typeOfMap, err := c.global.getType(v.Type().Elem())
-			typeOfMapKey, err := c.global.getType(v.Type().Key())
+			var typeOfMap, typeOfMapKey uint16
+
+			typeOfMap, err = c.valueType(v.Type().Elem())
+			if err != nil {
+				return 0, err
+			}
 
+			typeOfMapKey, err = c.valueType(v.Type().Key())
 			if err != nil {
 				return 0, err
 			}
 
+			// definitions are needed even for empty maps
+			c.useType(getArrayElementType(typeOfMap))
+			c.useType(getArrayElementType(typeOfMapKey))
+
 			// type of element
-			buffer.PutUint16(typeOfMap)
+			buffer.PutUint16(c.wireType(typeOfMap))
 
 			// type of key
-			buffer.PutUint16(typeOfMapKey)
+			buffer.PutUint16(c.wireType(typeOfMapKey))
+
+			err = c.enter(v)
+			if err != nil {
+				return 0, err
+			}
+			defer c.leave(v)
 
 			_, err = c.writeArrayLikeData(v, buffer, func(n int, v0 reflect.Value, b encode_buffer) error {
 
+				if c.options.Canonical {
+					for _, entry := range sortedMapEntries(v0) {
+						_, err = c.encodeElementToBuffer(b, entry.key)
+						if err != nil {
+							return err
+						}
+						_, err = c.encodeElementToBuffer(b, entry.value)
+						if err != nil {
+							return err
+						}
+					}
+
+					return nil
+				}
+
 				iter := v0.MapRange()
 
 				for iter.Next() {
@@ -205,7 +337,7 @@ func (c *encode_context) putReference(buffer encode_buffer, t uint16, v reflect.
 				return nil
 			})
 		default:
-			return 0, errors.New(fmt.Sprintf("Dont know how to reference such data type %s", v.Kind().String()))
+			return 0, &UnsupportedTypeError{v.Type()}
 		}
 	}
 
@@ -2,7 +2,6 @@ package codec
 
 import (
 	"encoding/binary"
-	"github.com/dot5enko/transbin/utils"
 )
 
 type references_reader struct {
@@ -21,45 +20,62 @@ func new_references_reader(order binary.ByteOrder) references_reader {
 	return result
 }
 
-func (this *references_reader) Get(id uint64) ([]byte, uint16, error) {
+// Get returns referenced data and its offset from the start of the message
+func (this *references_reader) Get(id uint64) ([]byte, int, error) {
 
-	if this.refsCount == 0 || id > this.refsCount {
-		return nil, 0, utils.Error("No such reference. refCount = %d", this.refsCount)
+	if this.refsCount == 0 || id == 0 || id > this.refsCount {
+		return nil, 0, errorf(ErrInvalidReference, "no reference %d, references count %d", id, this.refsCount)
 	}
 
 	pos := int(this.offsets[id])
 	var length uint16
 
 	this.buffer.GotoPos(pos)
-	this.buffer.ReadUint16(&length)
+	err := this.buffer.ReadUint16(&length)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	posStart := pos + 2
 
-	return this.buffer.allocator.data[posStart : posStart+int(length)], length, nil
+	err = this.buffer.ensure(int(length))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return this.buffer.allocator.data[posStart : posStart+int(length)], this.buffer.base + posStart, nil
 }
 
-func (this *references_reader) Init(data []byte) {
+// Init indexes references table, which starts at offset of the message
+func (this *references_reader) Init(data []byte, offset int) error {
 
 	dLen := len(data)
 
+	this.Reset()
+
 	this.buffer.Init(data)
+	this.buffer.base = offset
 	this.buffer.GotoPos(0)
 
-	for {
+	for this.buffer.pos < dLen {
 
 		this.refsCount++
 
 		this.offsets[this.refsCount] = uint64(this.buffer.pos)
-		this.buffer.ReadUint16(&this.dataLength)
-
-		this.buffer.Next(int(this.dataLength))
+		err := this.buffer.ReadUint16(&this.dataLength)
+		if err != nil {
+			return err
+		}
 
-		if this.buffer.pos >= dLen {
-			break
+		err = this.buffer.Next(int(this.dataLength))
+		if err != nil {
+			return err
 		}
 	}
 
 	this.buffer.GotoPos(0)
+
+	return nil
 }
 
 func (this *references_reader) Reset() {
@@ -0,0 +1,142 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReferencesRoundTrip(t *testing.T) {
+
+	values := [][]byte{[]byte("first"), {}, []byte("third reference"), bytes.Repeat([]byte{7}, maxReferenceLength)}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		w, err := NewReferencesWriter(16, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, v := range values {
+
+			// ids start from 1, 0 means no reference
+			if id := w.GetId(); id != uint64(i+1) {
+				t.Fatalf("reference %d got id %d", i, id)
+			}
+
+			if i%2 == 0 {
+				err = w.Put(v)
+			} else {
+				err = w.PutString(string(v))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// table is read at its offset in a message
+		const offset = 100
+
+		r := new_references_reader(order)
+
+		err = r.Init(w.buff.Bytes(), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pos := offset
+		for i, v := range values {
+
+			data, at, err := r.Get(uint64(i + 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(v, data) {
+				t.Fatalf("reference %d is %d bytes, expected %d", i+1, len(data), len(v))
+			}
+
+			// data follows its length
+			if at != pos+2 {
+				t.Fatalf("reference %d is at %d, expected %d", i+1, at, pos+2)
+			}
+			pos = at + len(v)
+		}
+
+		for _, id := range []uint64{0, uint64(len(values) + 1)} {
+			_, _, err = r.Get(id)
+			if !errors.Is(err, ErrInvalidReference) {
+				t.Fatalf("reference %d: expected ErrInvalidReference, got %v", id, err)
+			}
+		}
+	}
+}
+
+func TestReferencesWriterOverflow(t *testing.T) {
+
+	w, err := NewReferencesWriter(16, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.PutString(strings.Repeat("a", maxReferenceLength+1))
+	if !errors.Is(err, ErrReferenceOverflow) {
+		t.Fatalf("expected ErrReferenceOverflow for long data, got %v", err)
+	}
+
+	for w.count < w.cap {
+		w.GetId()
+	}
+
+	err = w.Put(nil)
+	if !errors.Is(err, ErrReferenceOverflow) {
+		t.Fatalf("expected ErrReferenceOverflow for too many references, got %v", err)
+	}
+
+	// reset writer starts from the first id with an empty table
+	w.Reset()
+
+	if id := w.GetId(); id != 1 || len(w.buff.Bytes()) != 0 {
+		t.Fatalf("reset writer gives id %d, has %d bytes", id, len(w.buff.Bytes()))
+	}
+
+	_, err = NewReferencesWriter(12, binary.LittleEndian)
+	if err == nil {
+		t.Fatal("address width is not checked")
+	}
+}
+
+func TestReferencesReaderTruncated(t *testing.T) {
+
+	w, err := NewReferencesWriter(16, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.GetId()
+	err = w.PutString("truncated reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := w.buff.Bytes()
+
+	for _, cut := range []int{1, 2, len(table) - 1} {
+
+		r := new_references_reader(binary.LittleEndian)
+
+		err = r.Init(table[:cut], 10)
+
+		var eofErr *UnexpectedEOFError
+		if !errors.Is(err, ErrUnexpectedEOF) || !errors.As(err, &eofErr) {
+			t.Fatalf("cut at %d: expected ErrUnexpectedEOF, got %v", cut, err)
+		}
+
+		// offsets are relative to the message
+		if eofErr.Offset < 10 || eofErr.Offset > 10+cut {
+			t.Fatalf("cut at %d: error at offset %d", cut, eofErr.Offset)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package codec
+
+// type_registry is an immutable snapshot of structure definitions known to a codec.
+// it is never modified after being published, registration builds a copy instead
+type type_registry struct {
+	types   map[uint16]*structDefinition
+	typeMap map[string]uint16
+}
+
+func newTypeRegistry() *type_registry {
+	return &type_registry{
+		types:   make(map[uint16]*structDefinition),
+		typeMap: make(map[string]uint16),
+	}
+}
+
+func (r *type_registry) byId(id uint16) (*structDefinition, bool) {
+	def, ok := r.types[id]
+	return def, ok
+}
+
+func (r *type_registry) byCode(code string) (uint16, bool) {
+	id, ok := r.typeMap[code]
+	return id, ok
+}
+
+func (r *type_registry) clone() *type_registry {
+	result := &type_registry{
+		types:   make(map[uint16]*structDefinition, len(r.types)+1),
+		typeMap: make(map[string]uint16, len(r.typeMap)+1),
+	}
+
+	for k, v := range r.types {
+		result.types[k] = v
+	}
+	for k, v := range r.typeMap {
+		result.typeMap[k] = v
+	}
+
+	return result
+}
+
+// definition returns registered structure definition by id
+func (c *codec) definition(id uint16) (*structDefinition, bool) {
+	return c.types().byId(id)
+}
+
+// current snapshot of known types, safe to use without locking
+func (c *codec) types() *type_registry {
+	return c.registry.Load().(*type_registry)
+}
+
+// sameDefinition reports whether definitions describe the same layout
+func sameDefinition(a, b *structDefinition) bool {
+
+	if a.FieldCount != b.FieldCount || a.Size != b.Size {
+		return false
+	}
+
+	for i := range a.Fields {
+		if a.Fields[i].Type != b.Fields[i].Type || a.Fields[i].Name != b.Fields[i].Name || a.Fields[i].Size != b.Fields[i].Size {
+			return false
+		}
+	}
+
+	return true
+}
+
+// definition returns structure definition by id, as seen by the decode context
+func (c *decode_context) definition(id uint16) (*structDefinition, bool) {
+
+	if def, ok := c.local[id]; ok {
+		return def, true
+	}
+
+	if def, ok := c.overrides[id]; ok {
+		return def, true
+	}
+
+	return c.global.types().byId(id)
+}
+
+// typeSize is getTypeSize, which respects definitions of the decode context
+func (c *decode_context) typeSize(t uint16) (int, error) {
+
+	if !isArrayType(t) && t > internalTypesCount {
+
+		def, ok := c.definition(t)
+		if !ok {
+			return 0, errorf(ErrUnknownType, "no definition for type %d", t)
+		}
+
+		return def.Size, nil
+	}
+
+	return kindSize(t)
+}
+
+// define makes definition from a message current for its id. definitions are kept
+// by the context, so messages never change the codec's registry. the ones equal
+// to registered definitions are dropped, others override registered ones until replaced.
+// definitions of canonical messages are used by the current message only
+func (c *decode_context) define(def *structDefinition) error {
+
+	// plans could refer to the previous definition
+	c.plans = nil
+
+	if c.hasHeader && c.header.Features&featureCanonical != 0 {
+		if c.local == nil {
+			c.local = make(map[uint16]*structDefinition)
+		}
+
+		c.local[def.Id] = def
+		return nil
+	}
+
+	if registered, ok := c.global.types().byId(def.Id); ok && sameDefinition(registered, def) {
+		delete(c.overrides, def.Id)
+		return nil
+	}
+
+	err := c.checkDefinedTypes(def.Id)
+	if err != nil {
+		return err
+	}
+
+	if c.overrides == nil {
+		c.overrides = make(map[uint16]*structDefinition)
+	}
+
+	c.overrides[def.Id] = def
+
+	return nil
+}
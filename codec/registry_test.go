@@ -0,0 +1,186 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newWideValue returns a structure of n nested structures, field names of which depend on prefix
+func newWideValue(prefix string, n int) interface{} {
+
+	fields := make([]reflect.StructField, n)
+	for i := range fields {
+		nested := reflect.StructOf([]reflect.StructField{{Name: fmt.Sprintf("%s%d", prefix, i), Type: reflect.TypeOf(0)}})
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("F%d", i), Type: nested}
+	}
+
+	return reflect.New(reflect.StructOf(fields)).Elem().Interface()
+}
+
+func TestDefinitionsStayInContext(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+	ctx := NewDecodeContext(c)
+
+	var sender *codec
+	var value interface{}
+
+	// every message brings its own definitions under the same ids
+	for i := 0; i < 50; i++ {
+
+		sender = newTestCodec(t, binary.LittleEndian)
+		value = newWideValue(fmt.Sprintf("M%dV", i), 200)
+
+		encoded, err := sender.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := ctx.DecodeDynamic(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		field := decoded.(map[string]interface{})["F7"].(map[string]interface{})
+		if _, ok := field[fmt.Sprintf("M%dV7", i)]; !ok {
+			t.Fatalf("message %d decoded with stale definitions: %v", i, field)
+		}
+	}
+
+	if n := len(c.types().types); n != 0 {
+		t.Fatalf("decoding registered %d definitions in the codec", n)
+	}
+
+	encoded, err := NewEncodeContext(sender).EncodeCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctx.DecodeDynamic(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other contexts of the codec don't know them
+	_, err = NewDecodeContext(c).DecodeDynamic(encoded)
+	if !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+
+	// codec registers its own structures from the first id
+	def, err := c.registerStructure(reflect.TypeOf(ProductVal{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def.Id != firstStructId {
+		t.Fatalf("first registered structure got id %d", def.Id)
+	}
+}
+
+func TestSharedCodecConcurrency(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	values := []interface{}{
+		newTestStruct(3),
+		newCanonicalStruct(),
+		mixedStruct{I32: 7, Floats: []float64{1, 2}, Strings: []string{"a"}, Attrs: map[string]interface{}{"k": "v"}, Counts: map[string]int{}, Any: 1.5, Items: []ProductVal{}},
+		ProductVal{"product", 1.5},
+		pointerContainers{List: []*ProductVal{{"a", 1}}, ByKey: map[string]*ProductVal{"b": {"b", 2}}},
+	}
+
+	var wg sync.WaitGroup
+
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+
+				// goroutines register types in different orders
+				value := values[(g+i)%len(values)]
+
+				encoded, err := c.Marshal(value)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				out := reflect.New(reflect.TypeOf(value))
+
+				err = c.Unmarshal(encoded, out.Interface())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if !reflect.DeepEqual(value, out.Elem().Interface()) {
+					t.Errorf("%T decoded differently", value)
+					return
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+}
+
+func TestAnonymousTypeCode(t *testing.T) {
+
+	intType, stringType := reflect.TypeOf(0), reflect.TypeOf("")
+
+	fields := []reflect.StructField{{Name: "A", Type: intType}, {Name: "B", Type: stringType}}
+	base := reflect.StructOf(fields)
+
+	// the same fields built again are the same type
+	again := reflect.StructOf([]reflect.StructField{{Name: "A", Type: intType}, {Name: "B", Type: stringType}})
+	if getTypeCode(again) != getTypeCode(base) {
+		t.Fatalf("codes of equal structures differ: %s, %s", getTypeCode(again), getTypeCode(base))
+	}
+
+	others := []reflect.Type{
+		reflect.StructOf([]reflect.StructField{fields[1], fields[0]}),
+		reflect.StructOf([]reflect.StructField{fields[0], {Name: "B", Type: stringType, Tag: `json:"b"`}}),
+		reflect.StructOf([]reflect.StructField{fields[0], {Name: "C", Type: stringType}}),
+		reflect.StructOf([]reflect.StructField{fields[0], {Name: "B", Type: intType}}),
+	}
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	def, err := c.registerStructure(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, other := range others {
+
+		if getTypeCode(other) == getTypeCode(base) {
+			t.Fatalf("structure %d has the code of %s", i, base)
+		}
+
+		otherDef, err := c.registerStructure(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if otherDef.Id == def.Id {
+			t.Fatalf("structure %d is registered as %s", i, base)
+		}
+	}
+
+	againDef, err := c.registerStructure(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if againDef.Id != def.Id {
+		t.Fatalf("equal structure got id %d, expected %d", againDef.Id, def.Id)
+	}
+}
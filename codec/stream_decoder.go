@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+)
+
+// stream_decoder reads frames written by stream_encoder.
+// structure definitions met in frames are accumulated by the decoder's context,
+// so data only frames could be decoded after the schema was received
+type stream_decoder struct {
+	ctx *decode_context
+	r   io.Reader
+
+	frameHeader [frameHeaderSize]byte
+	frame       []byte
+}
+
+func NewStreamDecoder(global *codec, r io.Reader) *stream_decoder {
+
+	result := &stream_decoder{}
+
+	result.ctx = NewDecodeContext(global)
+	result.r = r
+	result.frame = make([]byte, defaultBufferSize)
+
+	return result
+}
+
+// Next decodes the following frame into out, which should be a pointer.
+// returns io.EOF when the stream ends cleanly between frames
+// and ErrTruncatedFrame when it ends inside of one
+func (s *stream_decoder) Next(out interface{}) error {
+
+	_, err := io.ReadFull(s.r, s.frameHeader[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrTruncatedFrame
+		}
+		return err
+	}
+
+	frameSize := int(frameOrder.Uint32(s.frameHeader[:]))
+
+	err = s.ctx.checkMessageSize(frameSize)
+	if err != nil {
+		return decodeError(err, 0, 0)
+	}
+
+	// decoded strings may point into the frame, so it can't be reused
+	if s.ctx.options.ZeroCopyStrings {
+		s.frame = nil
+	}
+
+	err = s.readFrame(frameSize)
+	if err != nil {
+		return err
+	}
+
+	return s.ctx.Decode(out, s.frame)
+}
+
+// readFrame reads frame of size bytes. frames larger than the buffer are read
+// as their data arrives, so a length prefix alone doesn't allocate the whole frame
+func (s *stream_decoder) readFrame(size int) error {
+
+	if cap(s.frame) >= size {
+		s.frame = s.frame[:size]
+
+		_, err := io.ReadFull(s.r, s.frame)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return ErrTruncatedFrame
+		}
+		return err
+	}
+
+	buffer := bytes.NewBuffer(s.frame[:0])
+
+	n, err := buffer.ReadFrom(io.LimitReader(s.r, int64(size)))
+	s.frame = buffer.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if int(n) < size {
+		return ErrTruncatedFrame
+	}
+
+	return nil
+}
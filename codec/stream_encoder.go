@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const frameHeaderSize = 4
+
+// frame length is always little endian, independently of codec's byte order
+var frameOrder = binary.LittleEndian
+
+// stream_encoder writes a sequence of length delimited messages to io.Writer.
+// each frame is [payload length;4b;little endian][payload], where payload has the same layout
+// as EncodeFull output, but carries only structure definitions
+// not written to the stream before. the first frame holds the whole schema in use,
+// following ones are data only until a new structure appears
+type stream_encoder struct {
+	ctx *encode_context
+	w   io.Writer
+
+	frameHeader [frameHeaderSize]byte
+
+	// first write error, stream is unusable after it
+	err error
+}
+
+// NewStreamEncoder creates a stream encoder writing to w.
+// encoder issues two writes per message, so w is better to be buffered
+func NewStreamEncoder(global *codec, w io.Writer) *stream_encoder {
+
+	result := &stream_encoder{}
+
+	result.ctx = NewEncodeContext(global)
+	result.ctx.sentTypes = make(map[uint16]bool)
+	result.w = w
+
+	return result
+}
+
+// Encode writes obj as a single frame
+func (s *stream_encoder) Encode(obj interface{}) error {
+
+	if s.err != nil {
+		return s.err
+	}
+
+	payload, err := s.ctx.encodeInternal(obj, true)
+	if err != nil {
+		return err
+	}
+
+	frameOrder.PutUint32(s.frameHeader[:], uint32(len(payload)))
+
+	_, err = s.w.Write(s.frameHeader[:])
+	if err == nil {
+		_, err = s.w.Write(payload)
+	}
+
+	if err != nil {
+		s.err = err
+	}
+
+	return err
+}
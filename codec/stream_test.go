@@ -0,0 +1,209 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// splitFrames returns payloads of frames in stream
+func splitFrames(t *testing.T, stream []byte) [][]byte {
+
+	var result [][]byte
+
+	for len(stream) > 0 {
+		size := int(frameOrder.Uint32(stream))
+		if len(stream) < frameHeaderSize+size {
+			t.Fatalf("frame of %d bytes is cut at %d", size, len(stream)-frameHeaderSize)
+		}
+
+		result = append(result, stream[frameHeaderSize:frameHeaderSize+size])
+		stream = stream[frameHeaderSize+size:]
+	}
+
+	return result
+}
+
+func newStreamValues() []interface{} {
+	return []interface{}{
+		newTestStruct(2),
+		newTestStruct(5),
+		mixedStruct{I32: 3, Floats: []float64{1}, Strings: []string{"a", "b"}, Attrs: map[string]interface{}{"k": 1.5}, Counts: map[string]int{"c": 1}, Any: "any", Items: []ProductVal{{"item", 2}}},
+		newTestStruct(1),
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+
+	values := newStreamValues()
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+
+		var stream bytes.Buffer
+
+		encoder := NewStreamEncoder(newTestCodec(t, order), &stream)
+		for _, v := range values {
+			err := encoder.Encode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		decoder := NewStreamDecoder(newTestCodec(t, binary.LittleEndian), &stream)
+
+		for i, v := range values {
+			out := reflect.New(reflect.TypeOf(v))
+
+			err := decoder.Next(out.Interface())
+			if err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+
+			if !reflect.DeepEqual(v, out.Elem().Interface()) {
+				t.Fatalf("frame %d differs\nwant %+v\ngot  %+v", i, v, out.Elem().Interface())
+			}
+		}
+
+		err := decoder.Next(&TestStruct{})
+		if err != io.EOF {
+			t.Fatalf("expected io.EOF after the last frame, got %v", err)
+		}
+	}
+}
+
+func TestStreamSchemaSentOnce(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	var stream bytes.Buffer
+
+	encoder := NewStreamEncoder(c, &stream)
+	for _, v := range newStreamValues() {
+		err := encoder.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// TestStruct with its nested structures, nothing, mixedStruct only as ProductVal
+	// was sent before, nothing again
+	expected := []byte{4, 0, 1, 0}
+
+	frames := splitFrames(t, stream.Bytes())
+	if len(frames) != len(expected) {
+		t.Fatalf("%d frames written, expected %d", len(frames), len(expected))
+	}
+
+	for i, frame := range frames {
+		if !hasMessageHeader(frame) {
+			t.Fatalf("frame %d has no header", i)
+		}
+
+		if types := frame[messageHeaderSize]; types != expected[i] {
+			t.Fatalf("frame %d defines %d types, expected %d", i, types, expected[i])
+		}
+	}
+
+	// each stream of the codec sends its own schema
+	stream.Reset()
+
+	err := NewStreamEncoder(c, &stream).Encode(newTestStruct(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if types := splitFrames(t, stream.Bytes())[0][messageHeaderSize]; types != 4 {
+		t.Fatalf("first frame of a new stream defines %d types", types)
+	}
+}
+
+func TestStreamDecoderEnd(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	var stream bytes.Buffer
+
+	err := NewStreamEncoder(c, &stream).Encode(newTestStruct(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := stream.Bytes()
+
+	cases := map[string]struct {
+		stream []byte
+		frames int
+		err    error
+	}{
+		"empty":           {nil, 0, io.EOF},
+		"whole frame":     {full, 1, io.EOF},
+		"partial length":  {full[:2], 0, ErrTruncatedFrame},
+		"length only":     {full[:frameHeaderSize], 0, ErrTruncatedFrame},
+		"partial payload": {full[:len(full)-1], 0, ErrTruncatedFrame},
+		"partial second":  {append(append([]byte(nil), full...), full[:3]...), 1, ErrTruncatedFrame},
+	}
+
+	for name, tc := range cases {
+
+		decoder := NewStreamDecoder(c, bytes.NewReader(tc.stream))
+
+		for i := 0; i < tc.frames; i++ {
+			var out TestStruct
+			err = decoder.Next(&out)
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", name, i, err)
+			}
+		}
+
+		var out TestStruct
+		err = decoder.Next(&out)
+		if err != tc.err {
+			t.Fatalf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestStreamDecoderMaxMessageSize(t *testing.T) {
+
+	c := newTestCodec(t, binary.LittleEndian)
+
+	var stream bytes.Buffer
+
+	err := NewStreamEncoder(c, &stream).Encode(newTestStruct(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := len(stream.Bytes()) - frameHeaderSize
+
+	for _, limit := range []int{size - 1, size} {
+
+		decoder := NewStreamDecoder(c, bytes.NewReader(stream.Bytes()))
+		decoder.ctx.SetOptions(DecodeOptions{MaxMessageSize: limit})
+
+		var out TestStruct
+		err = decoder.Next(&out)
+
+		if limit < size && !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("frame of %d bytes is decoded with limit %d: %v", size, limit, err)
+		}
+		if limit == size && err != nil {
+			t.Fatalf("frame of %d bytes is rejected with limit %d: %v", size, limit, err)
+		}
+	}
+
+	// frame length is rejected before its payload is read
+	header := make([]byte, frameHeaderSize)
+	frameOrder.PutUint32(header, 1<<31)
+
+	decoder := NewStreamDecoder(c, bytes.NewReader(header))
+	decoder.ctx.SetOptions(DecodeOptions{MaxMessageSize: 1 << 20})
+
+	err = decoder.Next(&TestStruct{})
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got %v", err)
+	}
+}
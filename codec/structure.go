@@ -1,7 +1,6 @@
 package codec
 
 import (
-	"log"
 	"reflect"
 )
 
@@ -11,9 +10,6 @@ type structDefinition struct {
 	Id         uint16
 	Name       string
 
-	// not used
-	Offsets uint8
-
 	// size of codec structure
 	Size int
 }
@@ -21,12 +17,23 @@ type structDefinition struct {
 type codecStructField struct {
 	NameLength uint8
 	Name       string
-	Type       uint16 // reference to sturct definition
-	Offset     uintptr
+	Type       uint16  // reference to sturct definition
+	Offset     uintptr // offset of Go field, set in compiled plans only
 	Size       int
+
+	// Go slice of pointers, written as array of pointers when they are tracked
+	Pointers bool
 }
 
 func getTypeCode(ot reflect.Type) string {
+
+	// anonymous structures, including ones built with reflect.StructOf,
+	// are told apart by their fields. names, types, tags and order of fields
+	// are all in the code, so reordering fields or changing a tag gives another type
+	if ot.Name() == "" {
+		return ot.String()
+	}
+
 	// todo use string builder
 	// this code escapes to heap
 	return ot.PkgPath() + "." + ot.Name()
@@ -45,29 +52,80 @@ func getArrayElementType(typeId uint16) uint16 {
 	return typeId
 }
 
-func (c *encode_context) registerStructure(ot reflect.Type) (*structDefinition, error) {
+// structures in a message, fields in a structure and bytes in a field name
+// are counted by a single byte
+const maxDefinitionLength = 255
+
+func (c *codec) registerStructure(ot reflect.Type) (*structDefinition, error) {
+
+	if ot.Kind() == reflect.Ptr {
+		ot = ot.Elem()
+	}
+
+	// fast path, type is already known
+	current := c.types()
+	if value, ok := current.byCode(getTypeCode(ot)); ok {
+		def, _ := current.byId(value)
+		return def, nil
+	}
+
+	c.registerLock.Lock()
+	defer c.registerLock.Unlock()
+
+	typesCount := c.typesCount
+	pending := c.types().clone()
+
+	result, err := c.registerStructureLocked(pending, ot)
+	if err != nil {
+		// nothing was published, ids could be reused
+		c.typesCount = typesCount
+		return nil, err
+	}
+
+	c.registry.Store(pending)
+
+	return result, nil
+}
+
+// registerStructureLocked adds ot and all of its nested structures to pending registry.
+// should be called with registerLock held
+func (c *codec) registerStructureLocked(pending *type_registry, ot reflect.Type) (*structDefinition, error) {
 
 	if ot.Kind() == reflect.Ptr {
 		ot = ot.Elem()
 	}
 
 	name := getTypeCode(ot)
-	value, ok := c.global.typeMap[name]
+	value, ok := pending.typeMap[name]
 	if ok {
-		return c.global.types[value], nil
+		return pending.types[value], nil
 	} else {
 
 		fieldsCount := ot.NumField()
 
-		c.global.typesCount += 1
+		// counts and name lengths are single bytes in definitions
+		if fieldsCount > maxDefinitionLength {
+			return nil, errorf(ErrUnsupportedType, "%s has %d fields, over %d", ot, fieldsCount, maxDefinitionLength)
+		}
+
+		// registry holds only registered structures, so the next id is always free
+		c.typesCount += 1
+
+		if isArrayType(c.typesCount) {
+			return nil, errorf(ErrUnsupportedType, "%s is over %d structures a codec could register", ot, c.typesCount-firstStructId)
+		}
 
-		structDef := structDefinition{
+		structDef := &structDefinition{
 			Fields:     make([]codecStructField, fieldsCount),
-			Id:         c.global.typesCount,
+			Id:         c.typesCount,
 			FieldCount: uint8(fieldsCount),
 			Name:       name,
 		}
 
+		// known before the fields, so structures could refer to themselves through slices
+		pending.types[structDef.Id] = structDef
+		pending.typeMap[name] = structDef.Id
+
 		for i := 0; i < fieldsCount; i++ {
 
 			sf := &structDef.Fields[i]
@@ -75,21 +133,20 @@ func (c *encode_context) registerStructure(ot reflect.Type) (*structDefinition,
 			fData := ot.Field(i)
 			ft := fData.Type
 
-			sf.Name = fData.Name
-
-			actualLenght := len(fData.Name)
-			sf.NameLength = uint8(actualLenght)
-			if actualLenght != int(sf.NameLength) {
-				log.Printf("Field name is too long. field name was truncated, which may produce errors on decoding step")
+			if len(fData.Name) > maxDefinitionLength {
+				return nil, errorf(ErrUnsupportedType, "name of %s field %.16s... is %d bytes, over %d", ot, fData.Name, len(fData.Name), maxDefinitionLength)
 			}
 
+			sf.Name = fData.Name
+			sf.NameLength = uint8(len(fData.Name))
+
 			var err error
 
 			switch ft.Kind() {
 			case reflect.Struct:
 
 				// could produce npe
-				nested, err := c.registerStructure(ot.Field(i).Type)
+				nested, err := c.registerStructureLocked(pending, ot.Field(i).Type)
 				if err != nil {
 					return nil, err
 				}
@@ -98,6 +155,7 @@ func (c *encode_context) registerStructure(ot reflect.Type) (*structDefinition,
 			case reflect.Slice:
 
 				sliceElem := ft.Elem()
+				sf.Pointers = sliceElem.Kind() == reflect.Ptr
 
 				// unroll pointers
 				for {
@@ -113,9 +171,9 @@ func (c *encode_context) registerStructure(ot reflect.Type) (*structDefinition,
 				switch sliceElem.Kind() {
 				case reflect.Struct:
 					ok = false
-					typeWithArrayFlag, ok = c.global.typeMap[getTypeCode(sliceElem)]
+					typeWithArrayFlag, ok = pending.typeMap[getTypeCode(sliceElem)]
 					if !ok {
-						nested, err := c.registerStructure(sliceElem)
+						nested, err := c.registerStructureLocked(pending, sliceElem)
 						if err != nil {
 							return nil, err
 						}
@@ -131,54 +189,84 @@ func (c *encode_context) registerStructure(ot reflect.Type) (*structDefinition,
 				typeWithArrayFlag = setArrayTypeFlag(typeWithArrayFlag)
 				sf.Type = typeWithArrayFlag
 				sf.Size = 2 // reference
+			case reflect.Ptr:
+
+				// pointed types are registered when written, as ones in interfaces,
+				// so structures could point to themselves
+				sf.Type = uint16(reflect.Ptr)
+				sf.Size, _ = kindSize(sf.Type)
 			default:
 				sf.Type = uint16(ft.Kind())
-				sf.Size, err = c.global.getTypeSize(sf.Type)
+				sf.Size, err = c.getTypeSize(sf.Type)
 				if err != nil {
-					return nil, err
+					return nil, &UnsupportedTypeError{ft}
 				}
 			}
 
 			structDef.Size += sf.Size
 		}
 
-		c.global.types[structDef.Id] = &structDef
-		c.global.typeMap[name] = structDef.Id
-
-		return c.global.types[structDef.Id], nil
+		return structDef, nil
 	}
 }
 
 // todo no need to use separate buffer for structure
-func (c *encode_context) writeStructureData(buffer encode_buffer) {
+// when sentTypes is set, only types not written before are included
+// and they are remembered as sent. canonical messages always include all of them
+func (c *encode_context) writeStructureData(buffer encode_buffer) error {
 
 	numberOfTypes := c.usedTypes.Length()
 
-	if numberOfTypes > 255 {
-		panic("too much types nested")
+	sentTypes := c.sentTypes
+	if c.options.Canonical {
+		sentTypes = nil
+	}
+
+	if sentTypes != nil {
+		for i := 0; i < c.usedTypes.Length(); i++ {
+			if sentTypes[uint16(c.usedTypes.data[i])] {
+				numberOfTypes--
+			}
+		}
+	}
+
+	if numberOfTypes > maxDefinitionLength {
+		return errorf(ErrUnsupportedType, "message uses %d structures, over %d", numberOfTypes, maxDefinitionLength)
 	}
 
 	// number of types in list
 	buffer.WriteByte(uint8(numberOfTypes))
 
 	if numberOfTypes > 0 {
-		//
-		c.usedTypes.Sort()
 
-		for i := c.usedTypes.Length() - 1; i >= 0; i-- {
+		known := c.global.types()
+
+		// keep the order types were used in, dependencies go first
+		for i := 0; i < c.usedTypes.Length(); i++ {
 
 			v := c.usedTypes.data[i]
-			t := c.global.types[uint16(v)]
+
+			if sentTypes != nil {
+				if sentTypes[uint16(v)] {
+					continue
+				}
+				sentTypes[uint16(v)] = true
+			}
+
+			t, _ := known.byId(uint16(v))
 
 			// type id uint16
-			buffer.PutUint16(t.Id)
+			buffer.PutUint16(c.wireType(t.Id))
 
 			// number of fields uint8
 			buffer.WriteByte(t.FieldCount)
 
-			for _, f := range t.Fields {
+			for i := range t.Fields {
+
+				f := &t.Fields[i]
+
 				// field type
-				buffer.PutUint16(f.Type)
+				buffer.PutUint16(c.wireType(c.fieldType(f)))
 
 				// field name
 				buffer.WriteByte(f.NameLength)
@@ -186,4 +274,6 @@ func (c *encode_context) writeStructureData(buffer encode_buffer) {
 			}
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/dot5enko/transbin/codec"
+)
+
+// readInput reads named file or stdin for "-" or a missing name
+func readInput(fs *flag.FlagSet) ([]byte, error) {
+
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+
+	return ioutil.ReadFile(fs.Arg(0))
+}
+
+func writeOutput(path string, data []byte) error {
+
+	if path == "" || path == "-" {
+		_, err := stdout.Write(data)
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// runToJSON implements `transbin to-json [file]`
+func runToJSON(args []string) int {
+
+	fs := flag.NewFlagSet("to-json", flag.ExitOnError)
+	bigEndian := fs.Bool("be", false, "messages without a header are big endian")
+	output := fs.String("o", "", "output file, stdout by default")
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: transbin to-json [flags] [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	data, err := readInput(fs)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if *bigEndian {
+		order = binary.BigEndian
+	}
+
+	c, _ := codec.NewCodec(order)
+
+	ctx := c.AcquireDecoder()
+	defer ctx.Release()
+
+	value, err := ctx.DecodeDynamic(data)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	result, err := json.MarshalIndent(jsonValue(value, map[uintptr]bool{}), "", "  ")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	err = writeOutput(*output, append(result, '\n'))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// jsonValue converts maps with non string keys, which encoding/json refuses.
+// structures shared through pointers are converted once, cycles are reported by encoding/json
+func jsonValue(v interface{}, seen map[uintptr]bool) interface{} {
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		p := reflect.ValueOf(val).Pointer()
+		if seen[p] {
+			return val
+		}
+		seen[p] = true
+
+		for k, item := range val {
+			val[k] = jsonValue(item, seen)
+		}
+		return val
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			result[fmt.Sprint(k)] = jsonValue(item, seen)
+		}
+		return result
+	case []interface{}:
+		for i, item := range val {
+			val[i] = jsonValue(item, seen)
+		}
+		return val
+	default:
+		return val
+	}
+}
+
+// runFromJSON implements `transbin from-json --schema s.json [file]`
+func runFromJSON(args []string) int {
+
+	fs := flag.NewFlagSet("from-json", flag.ExitOnError)
+	schemaPath := fs.String("schema", "", "schema document describing message structures")
+	bigEndian := fs.Bool("be", false, "encode in big endian byte order")
+	output := fs.String("o", "", "output file, stdout by default")
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: transbin from-json --schema s.json [flags] [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *schemaPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	rootType, err := loadSchema(*schemaPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	data, err := readInput(fs)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	value := reflect.New(rootType)
+
+	err = json.Unmarshal(data, value.Interface())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if *bigEndian {
+		order = binary.BigEndian
+	}
+
+	c, _ := codec.NewCodec(order)
+
+	result, err := c.Marshal(value.Elem().Interface())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	err = writeOutput(*output, result)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	return 0
+}
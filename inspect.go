@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dot5enko/transbin/codec"
+)
+
+func orderName(order binary.ByteOrder) string {
+	if order == binary.BigEndian {
+		return "big endian"
+	}
+	return "little endian"
+}
+
+// runInspect implements `transbin inspect <file>`
+func runInspect(args []string) int {
+
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	bigEndian := fs.Bool("be", false, "messages without a header are big endian")
+	noValue := fs.Bool("no-value", false, "don't print decoded value")
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: transbin inspect [flags] <file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if *bigEndian {
+		order = binary.BigEndian
+	}
+
+	c, _ := codec.NewCodec(order)
+
+	info, err := c.Inspect(data)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	printMessageInfo(stdout, info, len(data))
+
+	if *noValue {
+		return 0
+	}
+
+	ctx := c.AcquireDecoder()
+	defer ctx.Release()
+
+	value, err := ctx.DecodeDynamic(data)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "\nvalue:\n")
+	printValue(stdout, value, 1, map[uintptr]bool{})
+	fmt.Fprintln(stdout)
+
+	return 0
+}
+
+func printMessageInfo(w io.Writer, info *codec.MessageInfo, size int) {
+
+	fmt.Fprintf(w, "message: %d bytes\n", size)
+
+	if info.Header != nil {
+		fmt.Fprintf(w, "header: version %d, %s, %d bit references, features %08b\n",
+			info.Header.Version, orderName(info.Header.Order), info.Header.ReferenceWidth, info.Header.Features)
+	} else {
+		fmt.Fprintf(w, "header: none\n")
+	}
+
+	fmt.Fprintf(w, "\ntypes: %d\n", len(info.Types))
+	for _, t := range info.Types {
+		fmt.Fprintf(w, "  %s: %d fields, %d bytes\n", codec.TypeName(t.Id), len(t.Fields), t.Size)
+		for _, f := range t.Fields {
+			fmt.Fprintf(w, "    %-20s %-16s %d bytes\n", f.Name, codec.TypeName(f.Type), f.Size)
+		}
+	}
+
+	fmt.Fprintf(w, "\ndata: %s at offset %d, %d bytes\n", codec.TypeName(info.RootType), info.DataOffset, info.DataSize)
+
+	fmt.Fprintf(w, "\nreferences: %d at offset %d\n", len(info.References), info.ReferencesOffset)
+	for _, ref := range info.References {
+		fmt.Fprintf(w, "  #%-5d offset %-8d length %d\n", ref.Id, ref.Offset, ref.Length)
+	}
+}
+
+// printValue prints decoded value. open holds structures being printed,
+// structures pointing back to them are printed as <cycle>
+func printValue(w io.Writer, v interface{}, indent int, open map[uintptr]bool) {
+
+	pad := strings.Repeat("  ", indent)
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		p := reflect.ValueOf(val).Pointer()
+		if open[p] {
+			fmt.Fprint(w, "<cycle>")
+			return
+		}
+		open[p] = true
+		defer delete(open, p)
+
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprint(w, "{")
+		for _, k := range keys {
+			fmt.Fprintf(w, "\n%s%s: ", pad, k)
+			printValue(w, val[k], indent+1, open)
+		}
+		fmt.Fprintf(w, "\n%s}", pad[2:])
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(val))
+		byKey := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			key := fmt.Sprintf("%v", k)
+			keys = append(keys, key)
+			byKey[key] = item
+		}
+		sort.Strings(keys)
+
+		fmt.Fprint(w, "{")
+		for _, k := range keys {
+			fmt.Fprintf(w, "\n%s%s: ", pad, k)
+			printValue(w, byKey[k], indent+1, open)
+		}
+		fmt.Fprintf(w, "\n%s}", pad[2:])
+	case []interface{}:
+		fmt.Fprint(w, "[")
+		for _, item := range val {
+			fmt.Fprintf(w, "\n%s", pad)
+			printValue(w, item, indent+1, open)
+		}
+		fmt.Fprintf(w, "\n%s]", pad[2:])
+	case string:
+		fmt.Fprintf(w, "%q", val)
+	default:
+		fmt.Fprintf(w, "%v", val)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dot5enko/transbin/codec"
+)
+
+type testItem struct {
+	Name  string
+	Price float64
+}
+
+type testOrder struct {
+	Id    int
+	Items []testItem
+	Tags  map[string]int
+}
+
+var testOrderValue = testOrder{
+	Id:    7,
+	Items: []testItem{{"apple", 1.5}, {"pear", 2}},
+	Tags:  map[string]int{"fresh": 1},
+}
+
+const testOrderJSON = `{
+  "Id": 7,
+  "Items": [
+    {
+      "Name": "apple",
+      "Price": 1.5
+    },
+    {
+      "Name": "pear",
+      "Price": 2
+    }
+  ],
+  "Tags": {
+    "fresh": 1
+  }
+}
+`
+
+const testOrderSchema = `{
+  "root": "Order",
+  "types": {
+    "Order": [{"name": "Id", "type": "int"}, {"name": "Items", "type": "[]Item"}, {"name": "Tags", "type": "map[string]int"}],
+    "Item":  [{"name": "Name", "type": "string"}, {"name": "Price", "type": "float64"}]
+  }
+}`
+
+// writeFixture encodes testOrderValue into a file of dir
+func writeFixture(t *testing.T, dir string, name string, order binary.ByteOrder, header bool) string {
+
+	c, err := codec.NewCodec(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !header {
+		c.SetEncodeOptions(codec.EncodeOptions{})
+	}
+
+	encoded, err := c.Marshal(testOrderValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeFile(t, dir, name, encoded)
+}
+
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+
+	path := filepath.Join(dir, name)
+
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// runCommand runs a command with input on stdin, returns its exit code and output
+func runCommand(run func([]string) int, args []string, input string) (int, string, string) {
+
+	var out, errOut bytes.Buffer
+
+	in, o, e := stdin, stdout, stderr
+	defer func() {
+		stdin, stdout, stderr = in, o, e
+	}()
+
+	stdin, stdout, stderr = strings.NewReader(input), &out, &errOut
+
+	code := run(args)
+
+	return code, out.String(), errOut.String()
+}
+
+func TestInspect(t *testing.T) {
+
+	dir := t.TempDir()
+
+	little := writeFixture(t, dir, "little.bin", binary.LittleEndian, true)
+	big := writeFixture(t, dir, "big.bin", binary.BigEndian, true)
+	bare := writeFixture(t, dir, "bare.bin", binary.BigEndian, false)
+	broken := writeFile(t, dir, "broken.bin", []byte("TRBN\x09"))
+
+	cases := []struct {
+		name     string
+		args     []string
+		code     int
+		contains []string
+		absent   []string
+	}{
+		{"header", []string{little}, 0, []string{"header: version 1, little endian, 16 bit references", "types: 2", "Items", "value:", `"apple"`, "fresh: 1"}, nil},
+		{"big endian", []string{big}, 0, []string{"big endian", "types: 2", `"pear"`}, nil},
+		{"no header", []string{"-be", bare}, 0, []string{"header: none", "types: 2", `"apple"`}, nil},
+		{"no value", []string{"-no-value", little}, 0, []string{"types: 2", "references:"}, []string{"value:"}},
+		{"broken", []string{broken}, 1, nil, nil},
+		{"missing file", []string{filepath.Join(dir, "missing.bin")}, 1, nil, nil},
+		{"no file", nil, 2, nil, nil},
+	}
+
+	for _, tc := range cases {
+
+		code, out, _ := runCommand(runInspect, tc.args, "")
+		if code != tc.code {
+			t.Fatalf("%s: exit code %d, expected %d\n%s", tc.name, code, tc.code, out)
+		}
+
+		for _, s := range tc.contains {
+			if !strings.Contains(out, s) {
+				t.Fatalf("%s: output has no %q\n%s", tc.name, s, out)
+			}
+		}
+
+		for _, s := range tc.absent {
+			if strings.Contains(out, s) {
+				t.Fatalf("%s: output has %q\n%s", tc.name, s, out)
+			}
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+
+	dir := t.TempDir()
+
+	little := writeFixture(t, dir, "little.bin", binary.LittleEndian, true)
+	bare := writeFixture(t, dir, "bare.bin", binary.BigEndian, false)
+	output := filepath.Join(dir, "out.json")
+
+	littleData, err := ioutil.ReadFile(little)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		args  []string
+		input string
+		code  int
+		file  string
+	}{
+		{"file", []string{little}, "", 0, ""},
+		{"stdin", []string{"-"}, string(littleData), 0, ""},
+		{"no header", []string{"-be", bare}, "", 0, ""},
+		{"output file", []string{"-o", output, little}, "", 0, output},
+		{"wrong order", []string{bare}, "", 1, ""},
+		{"missing file", []string{filepath.Join(dir, "missing.bin")}, "", 1, ""},
+	}
+
+	for _, tc := range cases {
+
+		code, out, _ := runCommand(runToJSON, tc.args, tc.input)
+		if code != tc.code {
+			t.Fatalf("%s: exit code %d, expected %d", tc.name, code, tc.code)
+		}
+
+		if code != 0 {
+			continue
+		}
+
+		if tc.file != "" {
+			data, err := ioutil.ReadFile(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = string(data)
+		}
+
+		if out != testOrderJSON {
+			t.Fatalf("%s: unexpected JSON\n%s", tc.name, out)
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+
+	dir := t.TempDir()
+
+	schemaPath := writeFile(t, dir, "schema.json", []byte(testOrderSchema))
+	input := writeFile(t, dir, "order.json", []byte(testOrderJSON))
+	output := filepath.Join(dir, "out.bin")
+
+	cases := []struct {
+		name  string
+		args  []string
+		input string
+		code  int
+		order binary.ByteOrder
+		file  string
+	}{
+		{"file", []string{"-schema", schemaPath, input}, "", 0, binary.LittleEndian, ""},
+		{"stdin", []string{"-schema", schemaPath}, testOrderJSON, 0, binary.LittleEndian, ""},
+		{"big endian", []string{"-schema", schemaPath, "-be", input}, "", 0, binary.BigEndian, ""},
+		{"output file", []string{"-schema", schemaPath, "-o", output, input}, "", 0, binary.LittleEndian, output},
+		{"invalid JSON", []string{"-schema", schemaPath}, `{"Id": "seven"}`, 1, nil, ""},
+		{"missing schema file", []string{"-schema", filepath.Join(dir, "missing.json"), input}, "", 1, nil, ""},
+		{"no schema", []string{input}, "", 2, nil, ""},
+	}
+
+	for _, tc := range cases {
+
+		code, out, _ := runCommand(runFromJSON, tc.args, tc.input)
+		if code != tc.code {
+			t.Fatalf("%s: exit code %d, expected %d", tc.name, code, tc.code)
+		}
+
+		if code != 0 {
+			continue
+		}
+
+		if tc.file != "" {
+			data, err := ioutil.ReadFile(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = string(data)
+		}
+
+		// messages are self describing, so they decode into Go types of the same shape
+		c, err := codec.NewCodec(tc.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded testOrder
+		err = c.Unmarshal([]byte(out), &decoded)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if !reflect.DeepEqual(testOrderValue, decoded) {
+			t.Fatalf("%s: decoded %+v", tc.name, decoded)
+		}
+
+		// and back to the same JSON
+		path := writeFile(t, dir, "roundtrip.bin", []byte(out))
+
+		code, back, _ := runCommand(runToJSON, []string{path}, "")
+		if code != 0 || back != testOrderJSON {
+			t.Fatalf("%s: converted back with code %d\n%s", tc.name, code, back)
+		}
+	}
+}
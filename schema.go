@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"strings"
+)
+
+// schema document describes structures of a message, so payloads could be built
+// without Go types. field types are int, int32, float32, float64, string, []byte
+// (base64 in JSON), interface, names of other structures, []T and map[K]V.
+// structures are anonymous, the ones with the same fields in the same order are
+// one type of the message:
+//
+//	{
+//	  "root": "Order",
+//	  "types": {
+//	    "Order": [{"name": "Id", "type": "int"}, {"name": "Items", "type": "[]Item"}],
+//	    "Item":  [{"name": "Name", "type": "string"}, {"name": "Price", "type": "float64"}]
+//	  }
+//	}
+type schema struct {
+	Root  string                   `json:"root"`
+	Types map[string][]schemaField `json:"types"`
+}
+
+type schemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+var schemaPrimitives = map[string]reflect.Type{
+	"int":       reflect.TypeOf(int(0)),
+	"int32":     reflect.TypeOf(int32(0)),
+	"float32":   reflect.TypeOf(float32(0)),
+	"float64":   reflect.TypeOf(float64(0)),
+	"string":    reflect.TypeOf(""),
+	"[]byte":    reflect.TypeOf([]byte(nil)),
+	"interface": reflect.TypeOf((*interface{})(nil)).Elem(),
+}
+
+// go types, values of which the codec doesn't encode
+var schemaUnsupported = map[string]bool{
+	"bool": true, "byte": true, "int8": true, "int16": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+}
+
+func loadSchema(path string) (reflect.Type, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s schema
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %w", path, err)
+	}
+
+	if s.Root == "" {
+		return nil, fmt.Errorf("schema %s: root type is not set", path)
+	}
+
+	resolver := schemaResolver{schema: &s, built: map[string]reflect.Type{}, resolving: map[string]bool{}}
+
+	return resolver.resolve(s.Root)
+}
+
+type schemaResolver struct {
+	schema    *schema
+	built     map[string]reflect.Type
+	resolving map[string]bool
+}
+
+func (r *schemaResolver) resolve(name string) (reflect.Type, error) {
+
+	name = strings.TrimSpace(name)
+
+	if t, ok := schemaPrimitives[name]; ok {
+		return t, nil
+	}
+
+	if schemaUnsupported[name] {
+		return nil, fmt.Errorf("type %s is not supported", name)
+	}
+
+	if strings.HasPrefix(name, "[]") {
+		elem, err := r.resolve(name[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	}
+
+	if strings.HasPrefix(name, "map[") {
+		end := strings.Index(name, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("malformed map type %s", name)
+		}
+
+		key, err := r.resolve(name[4:end])
+		if err != nil {
+			return nil, err
+		}
+
+		elem, err := r.resolve(name[end+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		return reflect.MapOf(key, elem), nil
+	}
+
+	return r.resolveStruct(name)
+}
+
+func (r *schemaResolver) resolveStruct(name string) (reflect.Type, error) {
+
+	if t, ok := r.built[name]; ok {
+		return t, nil
+	}
+
+	fields, ok := r.schema.Types[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s", name)
+	}
+
+	// reflect is unable to build recursive types
+	if r.resolving[name] {
+		return nil, fmt.Errorf("type %s is recursive", name)
+	}
+	r.resolving[name] = true
+	defer delete(r.resolving, name)
+
+	structFields := make([]reflect.StructField, len(fields))
+	names := make(map[string]bool, len(fields))
+
+	for i, f := range fields {
+
+		// reflect panics on anything else
+		if !token.IsIdentifier(f.Name) || !token.IsExported(f.Name) {
+			return nil, fmt.Errorf("type %s: field name %q should be an exported Go identifier", name, f.Name)
+		}
+
+		if names[f.Name] {
+			return nil, fmt.Errorf("type %s: duplicate field %s", name, f.Name)
+		}
+		names[f.Name] = true
+
+		ft, err := r.resolve(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("type %s, field %s: %w", name, f.Name, err)
+		}
+
+		structFields[i] = reflect.StructField{Name: f.Name, Type: ft}
+	}
+
+	result := reflect.StructOf(structFields)
+	r.built[name] = result
+
+	return result, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dot5enko/transbin/codec"
+)
+
+func TestLoadSchema(t *testing.T) {
+
+	dir := t.TempDir()
+
+	cases := []struct {
+		name     string
+		document string
+		result   string
+		err      string
+	}{
+		{"primitives", `{"root": "A", "types": {"A": [{"name": "I", "type": "int"}, {"name": "I32", "type": "int32"}, {"name": "F32", "type": "float32"}, {"name": "F", "type": "float64"}, {"name": "S", "type": "string"}, {"name": "Any", "type": "interface"}]}}`,
+			"struct { I int; I32 int32; F32 float32; F float64; S string; Any interface {} }", ""},
+		{"bytes", `{"root": "A", "types": {"A": [{"name": "Data", "type": "[]byte"}, {"name": "Blobs", "type": "[][]byte"}]}}`,
+			"struct { Data []uint8; Blobs [][]uint8 }", ""},
+		{"containers", `{"root": "A", "types": {"A": [{"name": "List", "type": "[]B"}, {"name": "ByKey", "type": "map[string]B"}, {"name": "Counts", "type": " map[int]float64 "}], "B": [{"name": "X", "type": "int"}]}}`,
+			"struct { List []struct { X int }; ByKey map[string]struct { X int }; Counts map[int]float64 }", ""},
+		{"primitive root", `{"root": "[]string", "types": {}}`, "[]string", ""},
+		{"bool", `{"root": "A", "types": {"A": [{"name": "Ok", "type": "bool"}]}}`, "", "type A, field Ok: type bool is not supported"},
+		{"int64 element", `{"root": "A", "types": {"A": [{"name": "L", "type": "[]int64"}]}}`, "", "type int64 is not supported"},
+		{"unknown", `{"root": "A", "types": {"A": [{"name": "B", "type": "Missing"}]}}`, "", "unknown type Missing"},
+		{"recursive", `{"root": "A", "types": {"A": [{"name": "B", "type": "[]B"}], "B": [{"name": "A", "type": "A"}]}}`, "", "type A is recursive"},
+		{"unexported", `{"root": "A", "types": {"A": [{"name": "x", "type": "int"}]}}`, "", `field name "x" should be an exported Go identifier`},
+		{"not identifier", `{"root": "A", "types": {"A": [{"name": "A-b", "type": "int"}]}}`, "", `field name "A-b" should be an exported Go identifier`},
+		{"space", `{"root": "A", "types": {"A": [{"name": "X Y", "type": "int"}]}}`, "", `field name "X Y" should be an exported Go identifier`},
+		{"empty name", `{"root": "A", "types": {"A": [{"name": "", "type": "int"}]}}`, "", `field name "" should be an exported Go identifier`},
+		{"duplicate", `{"root": "A", "types": {"A": [{"name": "X", "type": "int"}, {"name": "X", "type": "string"}]}}`, "", "type A: duplicate field X"},
+		{"unicode", `{"root": "A", "types": {"A": [{"name": "Ä", "type": "int"}]}}`, "struct { Ä int }", ""},
+		{"malformed map", `{"root": "A", "types": {"A": [{"name": "M", "type": "map[string"}]}}`, "", "malformed map type"},
+		{"no root", `{"types": {"A": [{"name": "X", "type": "int"}]}}`, "", "root type is not set"},
+		{"invalid JSON", `{"root": `, "", "unexpected end of JSON input"},
+	}
+
+	for i, tc := range cases {
+
+		path := writeFile(t, dir, fmt.Sprintf("schema%d.json", i), []byte(tc.document))
+
+		result, err := loadSchema(path)
+
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if result.String() != tc.result {
+			t.Fatalf("%s: built %s", tc.name, result)
+		}
+	}
+
+	_, err := loadSchema(filepath.Join(dir, "missing.json"))
+	if err == nil {
+		t.Fatal("missing schema is loaded")
+	}
+
+	// invalid names are reported by the command instead of panicking
+	for _, name := range []string{"A-b", "X"} {
+
+		path := writeFile(t, dir, "names.json", []byte(`{"root": "A", "types": {"A": [{"name": "X", "type": "int"}, {"name": "`+name+`", "type": "int"}]}}`))
+
+		code, _, errOut := runCommand(runFromJSON, []string{"-schema", path}, `{}`)
+		if code != 1 || errOut == "" {
+			t.Fatalf("field %s: exit code %d, %q", name, code, errOut)
+		}
+	}
+}
+
+func TestSchemaSameShape(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// Point and Size have the same fields, so they are one type of the message.
+	// Offset has them in another order and is a type of its own
+	schemaPath := writeFile(t, dir, "schema.json", []byte(`{
+  "root": "Box",
+  "types": {
+    "Box":    [{"name": "Point", "type": "Point"}, {"name": "Size", "type": "Size"}, {"name": "Offset", "type": "Offset"}, {"name": "Data", "type": "[]byte"}],
+    "Point":  [{"name": "X", "type": "int"}, {"name": "Y", "type": "int"}],
+    "Size":   [{"name": "X", "type": "int"}, {"name": "Y", "type": "int"}],
+    "Offset": [{"name": "Y", "type": "int"}, {"name": "X", "type": "int"}]
+  }
+}`))
+	input := `{"Point": {"X": 1, "Y": 2}, "Size": {"X": 3, "Y": 4}, "Offset": {"Y": 5, "X": 6}, "Data": "AQID"}`
+
+	code, out, errOut := runCommand(runFromJSON, []string{"-schema", schemaPath}, input)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, errOut)
+	}
+
+	c, err := codec.NewCodec(binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.Inspect([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Types) != 3 {
+		t.Fatalf("message defines %d types, expected 3", len(info.Types))
+	}
+
+	// bytes are base64 in JSON both ways
+	path := writeFile(t, dir, "box.bin", []byte(out))
+
+	code, back, errOut := runCommand(runToJSON, []string{path}, "")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, errOut)
+	}
+
+	for _, s := range []string{`"Data": "AQID"`, `"Y": 5`, `"X": 3`} {
+		if !strings.Contains(back, s) {
+			t.Fatalf("JSON has no %s\n%s", s, back)
+		}
+	}
+}
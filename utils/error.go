@@ -5,6 +5,9 @@ import (
 	"runtime/debug"
 )
 
+// CaptureStack enables stack traces in errors, it is expensive so disabled by default
+var CaptureStack = false
+
 type errorWithStackTrace struct {
 	msg string
 }
@@ -13,8 +16,13 @@ func (e errorWithStackTrace) Error() string {
 	return e.msg
 }
 
+// Error formats an error message, appending a stack trace if CaptureStack is set
 func Error(format string, args ...interface{}) error {
 
+	if !CaptureStack {
+		return errorWithStackTrace{fmt.Sprintf(format, args...)}
+	}
+
 	args = append(args, debug.Stack())
 
 	e := errorWithStackTrace{fmt.Sprintf(format+"\n\nStack:\n%s", args...)}